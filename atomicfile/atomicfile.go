@@ -0,0 +1,39 @@
+// Package atomicfile writes files so that readers, and the files themselves after a crash, see either the old or the new contents.
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes data to a temporary file next to path, syncs it to disk, and renames it over path.
+// A crash can't leave a partially written file behind, as it could with ioutil.WriteFile.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		// without this, the rename may reach the disk before the contents do
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
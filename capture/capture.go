@@ -0,0 +1,98 @@
+// Package capture takes screenshots with the platform's screenshot tool, for the Instant Share clients.
+package capture
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrCancelled is returned by Screenshot when the user cancelled taking the screenshot.
+var ErrCancelled = errors.New("screenshot was cancelled")
+
+// ErrNoCommand is returned by Screenshot when no screenshot tool was given or found.
+var ErrNoCommand = errors.New("no screenshot tool found; install one, or set the capture command")
+
+// linuxCommands are screenshot tools that let the user select an area, in order of preference.
+var linuxCommands = [][]string{
+	{"grim", "-g", `"$(slurp)"`}, // Wayland; the selection is made by slurp, whose "X,Y WxH" output is one argument.
+	{"maim", "-s"},
+	{"import"}, // ImageMagick.
+}
+
+// DefaultCommand returns the command of the platform's screenshot tool, or nil if none was found.
+// The path of the PNG file to write is appended to the command when it's run.
+func DefaultCommand() []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"screencapture", "-i"}
+	case "linux", "freebsd", "openbsd":
+		for _, command := range linuxCommands {
+			if _, err := exec.LookPath(command[0]); err != nil {
+				continue
+			}
+			if command[0] == "grim" {
+				if _, err := exec.LookPath("slurp"); err != nil {
+					continue
+				}
+			}
+			return command
+		}
+	}
+	return nil
+}
+
+// ParseCommand splits a command given by the user, like "maim -s", into its arguments.
+// Arguments can't contain spaces.
+func ParseCommand(s string) []string {
+	return strings.Fields(s)
+}
+
+// Screenshot runs command with the path of a temporary PNG file appended, and returns the PNG it wrote.
+// If command is empty, DefaultCommand is used. If the command writes nothing, as screenshot tools do when the
+// selection is cancelled, ErrCancelled is returned.
+func Screenshot(command []string) ([]byte, error) {
+	if len(command) == 0 {
+		command = DefaultCommand()
+	}
+	if len(command) == 0 {
+		return nil, ErrNoCommand
+	}
+
+	dir, err := ioutil.TempDir("", "instantshare")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "screenshot.png")
+
+	var cmd *exec.Cmd
+	if strings.Contains(strings.Join(command, " "), "$(") {
+		// the command relies on the shell, like grim taking its selection from slurp
+		cmd = exec.Command("sh", "-c", strings.Join(command, " ")+` "$0"`, path)
+	} else {
+		cmd = exec.Command(command[0], append(command[1:], path)...)
+	}
+	cmd.Stderr = os.Stderr
+
+	runErr := cmd.Run()
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+		if _, exited := runErr.(*exec.ExitError); runErr != nil && !exited {
+			// the tool couldn't be started
+			return nil, runErr
+		}
+		// some tools exit with an error status when cancelled, others don't
+		return nil, ErrCancelled
+	} else if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
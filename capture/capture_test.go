@@ -0,0 +1,57 @@
+package capture
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScreenshot(t *testing.T) {
+	// a fake screenshot tool that writes a known PNG signature to the file it's given
+	b, err := Screenshot([]string{"sh", "-c", `printf '\211PNG' > "$0"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("\x89PNG")) {
+		t.Errorf("got %q, want %q", b, "\x89PNG")
+	}
+}
+
+func TestScreenshotCancelled(t *testing.T) {
+	// a tool that exits without writing anything, as when the user presses Escape
+	_, err := Screenshot([]string{"sh", "-c", "exit 1"})
+	if err != ErrCancelled {
+		t.Errorf("got %v, want ErrCancelled", err)
+	}
+
+	_, err = Screenshot([]string{"instantshare-no-such-screenshot-tool"})
+	if err == nil || err == ErrCancelled {
+		t.Errorf("got %v for a missing tool, want an error", err)
+	}
+}
+
+func TestScreenshotWithSelection(t *testing.T) {
+	// fake slurp and grim, where grim writes the geometry it got to the file, if it got it as one argument
+	dir := t.TempDir()
+	tools := map[string]string{
+		"slurp": "#!/bin/sh\necho '10,20 300x400'\n",
+		"grim":  "#!/bin/sh\n[ \"$1\" = -g ] && [ $# -eq 3 ] && printf '%s' \"$2\" > \"$3\"\n",
+	}
+	for name, script := range tools {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	b, err := Screenshot(linuxCommands[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "10,20 300x400" {
+		t.Errorf("grim got geometry %q, want %q", b, "10,20 300x400")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pavben/InstantShare/imageconv"
+	"github.com/shurcooL/go/open"
+	"github.com/shurcooL/trayhost"
+)
+
+// clientConfig holds the preferences of the client, which are kept in a JSON file in the user's config directory.
+// Settings given as command-line flags take precedence over the file.
+type clientConfig struct {
+	Host           string   // Target server host, like "share.example.com".
+	Key            string   // API key for the target server.
+	TTL            duration // If non-zero, shares expire after this long.
+	CaptureCommand string   // Command that takes a screenshot; empty for the platform's screenshot tool.
+
+	Image struct {
+		Format   string // Format that copied images and screenshots are uploaded in: "png", "jpeg" or "webp".
+		Quality  int    // Quality of JPEG and WebP images, from 1 to 100.
+		MaxWidth int    // If non-zero, wider images are scaled down to this width, like Retina screenshots to 1x.
+	}
+
+	Notifications struct {
+		Shared    bool // Notify when a link is ready.
+		Completed bool // Notify when an upload is complete.
+	}
+}
+
+// defaultConfig returns the preferences used for settings missing from the config file.
+func defaultConfig() clientConfig {
+	var cfg clientConfig
+	cfg.Image.Format = "png"
+	cfg.Image.Quality = imageconv.DefaultQuality
+	cfg.Notifications.Shared = true
+	cfg.Notifications.Completed = true
+	return cfg
+}
+
+// duration is a time.Duration kept in JSON as a string, like "24h".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	if d == 0 {
+		return json.Marshal("")
+	}
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// loadedConfig is the config file as it was last read. It's read again whenever it has changed,
+// so edits made through the Preferences menu item take effect without restarting.
+var loadedConfig struct {
+	config  clientConfig
+	modTime time.Time
+
+	sync.Mutex
+}
+
+// configPath returns the path of the config file.
+func configPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "Instant Share", "config.json"), nil
+}
+
+// currentConfig returns the current preferences, from the config file and the command-line flags.
+func currentConfig() clientConfig {
+	loadedConfig.Lock()
+	defer loadedConfig.Unlock()
+
+	err := reloadConfig()
+	if err != nil {
+		log.Println("Failed to load config:", err)
+	}
+
+	cfg := loadedConfig.config
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			cfg.Host = *hostFlag
+		case "key":
+			cfg.Key = *keyFlag
+		case "ttl":
+			cfg.TTL = duration(*ttlFlag)
+		case "capture-command":
+			cfg.CaptureCommand = *captureCommandFlag
+		}
+	})
+
+	return cfg
+}
+
+// reloadConfig reads the config file if it changed since it was last read. The caller must hold the lock.
+// If the file can't be read or parsed, the last good preferences are kept.
+func reloadConfig() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		loadedConfig.config = defaultConfig()
+		loadedConfig.modTime = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(loadedConfig.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	cfg := defaultConfig()
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if imageconv.Extension(cfg.Image.Format) == "" {
+		return fmt.Errorf("%s: Image.Format must be \"png\", \"jpeg\" or \"webp\"", path)
+	}
+
+	loadedConfig.config = cfg
+	loadedConfig.modTime = fi.ModTime()
+
+	log.Println("Loaded config from", path)
+
+	return nil
+}
+
+// preferencesHandler opens the config file for editing, creating it with the current preferences if it doesn't exist.
+func preferencesHandler() {
+	path, err := configPath()
+	if err == nil {
+		err = createConfigFile(path)
+	}
+	if err != nil {
+		trayhost.Notification{Title: "Preferences Unavailable", Body: err.Error()}.Display()
+		log.Println(err)
+		return
+	}
+
+	open.Open(path)
+}
+
+// createConfigFile writes the current preferences to a new config file at path, unless it exists.
+func createConfigFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(currentConfig(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	// the file holds the API key
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pavben/InstantShare/atomicfile"
+)
+
+// maxHistoryEntries is how many of the most recent shares are remembered.
+const maxHistoryEntries = 100
+
+// historyEntry is a share that was made from this computer.
+type historyEntry struct {
+	URL         string
+	DeleteToken string
+	Name        string    // What was shared, like "movie.mov" or "3 files".
+	Path        string    `json:",omitempty"` // Path of the shared file or directory, if it came from one.
+	Extension   string    `json:",omitempty"`
+	Created     time.Time // When the share was made.
+	Deleted     bool      `json:",omitempty"`
+}
+
+// history keeps the most recent shares in a JSON file in the app data directory,
+// so that links can be found again after the clipboard has been overwritten.
+var history struct {
+	entries []historyEntry // Oldest first.
+	loaded  bool
+
+	sync.Mutex
+}
+
+// historyPath returns the path of the history file.
+func historyPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "Instant Share", "history.json"), nil
+}
+
+// loadHistory reads the history file, unless it has been read already. The caller must hold the lock.
+func loadHistory() error {
+	if history.loaded {
+		return nil
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		// nothing shared yet
+	case err != nil:
+		return err
+	default:
+		err = json.Unmarshal(b, &history.entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	history.loaded = true
+	return nil
+}
+
+// saveHistory writes the history file. The caller must hold the lock.
+func saveHistory() error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(history.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, b, 0600)
+}
+
+// addToHistory remembers a new share, forgetting the oldest ones beyond maxHistoryEntries.
+func addToHistory(entry historyEntry) error {
+	history.Lock()
+	defer history.Unlock()
+
+	err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	history.entries = append(history.entries, entry)
+	if len(history.entries) > maxHistoryEntries {
+		history.entries = history.entries[len(history.entries)-maxHistoryEntries:]
+	}
+
+	return saveHistory()
+}
+
+// recentShares returns the remembered shares, most recent first.
+func recentShares() ([]historyEntry, error) {
+	history.Lock()
+	defer history.Unlock()
+
+	err := loadHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]historyEntry, len(history.entries))
+	for i, entry := range history.entries {
+		entries[len(entries)-1-i] = entry
+	}
+
+	return entries, nil
+}
+
+// markDeletedInHistory records that the share at url was deleted from the server.
+func markDeletedInHistory(url string) error {
+	history.Lock()
+	defer history.Unlock()
+
+	err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	for i := range history.entries {
+		if history.entries[i].URL == url {
+			history.entries[i].Deleted = true
+		}
+	}
+
+	return saveHistory()
+}
+
+// historyEntryByURL returns the remembered share at url, if there is one.
+func historyEntryByURL(url string) (historyEntry, bool) {
+	history.Lock()
+	defer history.Unlock()
+
+	if loadHistory() != nil {
+		return historyEntry{}, false
+	}
+
+	for _, entry := range history.entries {
+		if entry.URL == url {
+			return entry, true
+		}
+	}
+
+	return historyEntry{}, false
+}
@@ -2,42 +2,53 @@
 package main
 
 import (
-	"bytes"
 	"flag"
-	"fmt"
-	"image"
-	"image/png"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
 
-	"github.com/shurcooL/go/open"
+	"github.com/pavben/InstantShare/capture"
 	"github.com/shurcooL/trayhost"
-	_ "golang.org/x/image/tiff"
 )
 
-var hostFlag = flag.String("host", "", "Target server host.")
+// These flags override the preferences in the config file, which can be opened with the Preferences menu item.
+var hostFlag = flag.String("host", "", `Target server host, like "share.example.com". HTTPS is used unless another scheme is given, like "http://localhost:27080".`)
+var keyFlag = flag.String("key", "", "API key for the target server.")
+var ttlFlag = flag.Duration("ttl", 0, "If non-zero, shares expire after this long (e.g., 24h).")
+var captureCommandFlag = flag.String("capture-command", "", `Command that takes a screenshot, like "maim -s", with the path of the PNG file to write appended. Defaults to the platform's screenshot tool.`)
 var debugFlag = flag.Bool("debug", false, "Adds menu items for debugging purposes.")
 
-var httpClient = &http.Client{Timeout: 3 * time.Second}
-
 var clipboard struct {
-	extension string // File extension in lower case: "png", "tiff", "mov", etc. Empty string means no content.
-	bytes     []byte
+	extension string   // File extension in lower case: "png", "tiff", "mov", etc. Empty string means no content.
+	name      string   // Original file name, if the content came from a file.
+	bytes     []byte   // Content that isn't in a file, like a copied image or text.
+	path      string   // Path of a copied file or directory, which is streamed from disk while uploading. Directories are zipped.
+	files     []string // Paths of the files to share as a bundle, when several files were copied.
+	image     bool     // The content is a copied image, which is converted to the preferred format when it's shared.
 }
 var notificationThumbnail trayhost.Image
 
-// fileThumbnail returns a thumbnail image that represents the input file, or an empty image if it cannot.
-func fileThumbnail(extension string, bytes []byte) trayhost.Image {
+// maxThumbnailFileSize is the size of the largest image file that's read to show as a notification thumbnail.
+const maxThumbnailFileSize = 10 * 1024 * 1024
+
+// fileThumbnail returns a thumbnail image that represents the file at path, or an empty image if it cannot.
+func fileThumbnail(extension string, path string) trayhost.Image {
 	switch extension {
 	case "jpg", "jpeg":
 		fallthrough
 	case "png":
-		return trayhost.Image{Kind: trayhost.ImageKind(extension), Bytes: bytes}
+		fi, err := os.Stat(path)
+		if err != nil || fi.Size() > maxThumbnailFileSize {
+			return trayhost.Image{}
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return trayhost.Image{}
+		}
+		return trayhost.Image{Kind: trayhost.ImageKind(extension), Bytes: b}
 	default:
 		return trayhost.Image{}
 	}
@@ -53,41 +64,57 @@ func instantShareEnabled() bool {
 		return false
 	}
 
+	clipboard.bytes = nil
+	clipboard.path = ""
+	clipboard.files = nil
+	clipboard.image = false
+
 	switch {
+	case len(cc.Files) > 1: // Several files, shared as a bundle.
+		for _, path := range cc.Files {
+			fi, err := os.Stat(path)
+			if err != nil || (!fi.Mode().IsRegular() && !fi.IsDir()) {
+				return false
+			}
+		}
+		clipboard.extension = ""
+		clipboard.name = ""
+		clipboard.files = cc.Files
+		notificationThumbnail = trayhost.Image{}
+		return true
+	case len(cc.Files) == 1 && isDirectory(cc.Files[0]): // Single directory.
+		clipboard.extension = "zip"
+		clipboard.name = filepath.Base(cc.Files[0]) + ".zip"
+		clipboard.path = cc.Files[0]
+		notificationThumbnail = trayhost.Image{}
+		return true
 	case len(cc.Files) == 1: // Single file.
-		b, err := ioutil.ReadFile(cc.Files[0])
-		if err != nil {
+		// only check that the file can be shared; it's read while uploading, and its thumbnail when it's shared
+		fi, err := os.Stat(cc.Files[0])
+		if err != nil || !fi.Mode().IsRegular() {
 			return false
 		}
-		extension := strings.TrimPrefix(filepath.Ext(cc.Files[0]), ".")
-		clipboard.extension = extension
-		clipboard.bytes = b
-		notificationThumbnail = fileThumbnail(extension, b)
+		clipboard.extension = strings.TrimPrefix(filepath.Ext(cc.Files[0]), ".")
+		clipboard.name = filepath.Base(cc.Files[0])
+		clipboard.path = cc.Files[0]
+		notificationThumbnail = trayhost.Image{}
 		return true
 	case cc.Image.Kind != "":
 		clipboard.extension = string(cc.Image.Kind)
+		clipboard.name = ""
 		clipboard.bytes = cc.Image.Bytes
+		clipboard.image = true
 		notificationThumbnail = cc.Image
-
-		// Convert some source clipboard image types to desired destination format.
-		switch clipboard.extension {
-		case "tiff":
-			// Convert tiff to png.
-			m, _, err := image.Decode(bytes.NewReader(clipboard.bytes))
-			if err != nil {
-				log.Panicln("image.Decode:", err)
-			}
-
-			var buf bytes.Buffer
-			err = png.Encode(&buf, m)
-			if err != nil {
-				log.Panicln("png.Encode:", err)
-			}
-
-			clipboard.extension = "png"
-			clipboard.bytes = buf.Bytes()
+		return true
+	case strings.TrimSpace(cc.Text) != "": // Text, shared as a paste.
+		if newClient().IsShareURL(strings.TrimSpace(cc.Text)) {
+			// the link to what was just shared, which the clipboard holds afterwards
+			return false
 		}
-
+		clipboard.extension = textExtension(cc.Text)
+		clipboard.name = ""
+		clipboard.bytes = []byte(cc.Text)
+		notificationThumbnail = trayhost.Image{}
 		return true
 	default:
 		return false
@@ -95,61 +122,38 @@ func instantShareEnabled() bool {
 }
 
 func instantShareHandler() {
-	log.Println("request URL")
-
-	resp, err := httpClient.Get(*hostFlag + "/api/getfilename?ext=" + clipboard.extension)
-	if err != nil {
-		trayhost.Notification{Title: "Upload Failed", Body: err.Error()}.Display()
-		log.Println(err)
-		return
+	job := &shareJob{
+		extension: clipboard.extension,
+		name:      clipboard.name,
+		bytes:     clipboard.bytes,
+		path:      clipboard.path,
+		files:     clipboard.files,
+		thumbnail: notificationThumbnail,
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		err := fmt.Errorf("did not get acceptable status code: %v body: %q", resp.Status, body)
-		trayhost.Notification{Title: "Upload Failed", Body: err.Error()}.Display()
-		log.Println(err)
-		return
+	if clipboard.image {
+		job.convertImage()
 	}
-	filename, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		trayhost.Notification{Title: "Upload Failed", Body: err.Error()}.Display()
+	job.start()
+}
+
+// captureHandler lets the user take a screenshot, and shares it like a copied image.
+func captureHandler() {
+	b, err := capture.Screenshot(capture.ParseCommand(currentConfig().CaptureCommand))
+	if err == capture.ErrCancelled {
+		return
+	} else if err != nil {
+		trayhost.Notification{Title: "Screenshot Failed", Body: err.Error()}.Display()
 		log.Println(err)
 		return
 	}
 
-	log.Println("display/put URL in clipboard")
-
-	url := *hostFlag + "/" + string(filename)
-	trayhost.SetClipboardText(url)
-	trayhost.Notification{
-		Title:   "Success",
-		Body:    url,
-		Image:   notificationThumbnail,
-		Timeout: 3 * time.Second,
-		Handler: func() {
-			// On click, open the displayed URL.
-			open.Open(url)
-		},
-	}.Display()
-
-	log.Println("upload image in background of size", len(clipboard.bytes))
-
-	go func(b []byte) {
-		req, err := http.NewRequest("PUT", url, bytes.NewReader(b))
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		req.Header.Set("Content-Type", "application/octet-stream")
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		_ = resp.Body.Close()
-		log.Println("done")
-	}(clipboard.bytes)
+	job := &shareJob{
+		extension: "png",
+		bytes:     b,
+		thumbnail: trayhost.Image{Kind: trayhost.ImageKindPNG, Bytes: b},
+	}
+	job.convertImage()
+	job.start()
 }
 
 func init() { log.SetFlags(0) }
@@ -165,7 +169,24 @@ func main() {
 			Enabled: instantShareEnabled,
 			Handler: instantShareHandler,
 		},
+		{
+			Title:   "Capture Screenshot",
+			Handler: captureHandler,
+		},
+		{
+			Title:   "Recent Shares…",
+			Handler: recentSharesHandler,
+		},
+		{
+			Title:   "Show Upload Progress",
+			Enabled: uploadProgressEnabled,
+			Handler: uploadProgressHandler,
+		},
 		trayhost.SeparatorMenuItem(),
+		{
+			Title:   "Preferences…",
+			Handler: preferencesHandler,
+		},
 		{
 			Title:   "Quit",
 			Handler: trayhost.Exit,
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// pasteLanguages are patterns that recognize copied source code, and the file extension it's shared with,
+// which the server uses to highlight it. They're tried in order; text matching none is shared as "txt".
+var pasteLanguages = []struct {
+	pattern   *regexp.Regexp
+	extension string
+}{
+	{regexp.MustCompile(`^#!.*\b(sh|bash|zsh)\b`), "sh"},
+	{regexp.MustCompile(`^#!.*\bpython`), "py"},
+	{regexp.MustCompile(`^#!.*\bnode\b`), "js"},
+	{regexp.MustCompile(`^#!.*\bruby\b`), "rb"},
+	{regexp.MustCompile(`(?m)^(diff --git |--- \S.*\n\+\+\+ \S)`), "diff"},
+	{regexp.MustCompile(`(?m)^package \w+$[\s\S]*^(func|import|type|var|const) `), "go"},
+	{regexp.MustCompile(`(?m)^#include [<"]`), "c"},
+	{regexp.MustCompile(`(?m)^(def \w+\(.*\):|from [\w.]+ import |import \w+$|class \w+(\(.*\))?:$)`), "py"},
+	{regexp.MustCompile(`(?m)^(fn |use \w+::|pub (fn|struct|enum) |impl )`), "rs"},
+	{regexp.MustCompile(`(?m)^(public |private )?(class|interface) \w+.*\{`), "java"},
+	{regexp.MustCompile(`(?m)^\s*(function \w+\(|(const|let) \w+ = |import .* from ['"]|export (default|function|const) )`), "js"},
+	{regexp.MustCompile(`(?im)^\s*(SELECT .+ FROM |INSERT INTO |CREATE TABLE |UPDATE \w+ SET )`), "sql"},
+}
+
+// textExtension returns the file extension to share the copied text with, detecting the language of source code.
+func textExtension(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+	for _, language := range pasteLanguages {
+		if language.pattern.MatchString(text) {
+			return language.extension
+		}
+	}
+	return "txt"
+}
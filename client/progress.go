@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pavben/InstantShare/upload"
+	"github.com/shurcooL/trayhost"
+)
+
+// trackedUpload is an upload in progress, whose progress is shown by the "Show Upload Progress" menu item.
+type trackedUpload struct {
+	name  string
+	total int64 // -1 if unknown.
+	sent  int64
+
+	sync.Mutex
+}
+
+var trackedUploads struct {
+	uploads []*trackedUpload
+
+	sync.Mutex
+}
+
+// uploadWithProgress uploads r like client.Upload, tracking its progress under name while it's in progress.
+func uploadWithProgress(client *upload.Client, shareURL string, r io.Reader, size int64, name string) error {
+	tu := &trackedUpload{
+		name:  name,
+		total: size,
+	}
+
+	trackedUploads.Lock()
+	trackedUploads.uploads = append(trackedUploads.uploads, tu)
+	trackedUploads.Unlock()
+
+	defer func() {
+		trackedUploads.Lock()
+		defer trackedUploads.Unlock()
+
+		for i, u := range trackedUploads.uploads {
+			if u == tu {
+				trackedUploads.uploads = append(trackedUploads.uploads[:i], trackedUploads.uploads[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	return client.Upload(shareURL, r, size, func(sent int64) {
+		tu.Lock()
+		tu.sent = sent
+		tu.Unlock()
+	})
+}
+
+// String describes the progress of the upload, like "movie.mov: 45% (12.3 MiB of 27.0 MiB)".
+func (tu *trackedUpload) String() string {
+	tu.Lock()
+	defer tu.Unlock()
+
+	if tu.total <= 0 {
+		return fmt.Sprintf("%s: %s", tu.name, upload.FormatSize(tu.sent))
+	}
+
+	return fmt.Sprintf("%s: %d%% (%s of %s)", tu.name, tu.sent*100/tu.total, upload.FormatSize(tu.sent), upload.FormatSize(tu.total))
+}
+
+// uploadProgressEnabled returns true if there are uploads in progress.
+func uploadProgressEnabled() bool {
+	trackedUploads.Lock()
+	defer trackedUploads.Unlock()
+
+	return len(trackedUploads.uploads) > 0
+}
+
+// uploadProgressHandler shows the progress of uploads in a notification, since menu item titles can't change.
+func uploadProgressHandler() {
+	trackedUploads.Lock()
+	var lines []string
+	for _, tu := range trackedUploads.uploads {
+		lines = append(lines, tu.String())
+	}
+	trackedUploads.Unlock()
+
+	if len(lines) == 0 {
+		lines = []string{"All uploads are done."}
+	}
+
+	trayhost.Notification{
+		Title: "Upload Progress",
+		Body:  strings.Join(lines, "\n"),
+	}.Display()
+}
+
+// displayName returns a name to show for shared content, which may not have come from a file.
+func displayName(name string, extension string) string {
+	if name != "" {
+		return name
+	}
+	return "clipboard." + extension
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/shurcooL/go/open"
+	"github.com/shurcooL/trayhost"
+)
+
+// thumbnailWidth is the width of the thumbnails of images on the Recent Shares page, which are shown at half of it
+// so that they're sharp on high density displays.
+const thumbnailWidth = 128
+
+// thumbnails holds the thumbnails of shared images that have been fetched, by share URL. Fetching them again every time
+// the page is shown would be slow, and they never change.
+var thumbnails = struct {
+	images map[string][]byte
+	sync.Mutex
+}{images: make(map[string][]byte)}
+
+// The tray menu can't have submenus, so recent shares are listed on a page served to the browser from this computer.
+// The page is only reachable at a secret path, so that other websites can't use it to copy or delete shares.
+var recentSharesServer struct {
+	url  string
+	err  error
+	once sync.Once
+}
+
+// recentSharesHandler opens the Recent Shares page in the browser.
+func recentSharesHandler() {
+	recentSharesServer.once.Do(startRecentSharesServer)
+	if recentSharesServer.err != nil {
+		trayhost.Notification{Title: "Recent Shares Unavailable", Body: recentSharesServer.err.Error()}.Display()
+		log.Println(recentSharesServer.err)
+		return
+	}
+
+	open.Open(recentSharesServer.url)
+}
+
+func startRecentSharesServer() {
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	if err != nil {
+		recentSharesServer.err = err
+		return
+	}
+	prefix := "/" + hex.EncodeToString(secret) + "/"
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		recentSharesServer.err = err
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != prefix {
+			http.NotFound(w, req)
+			return
+		}
+		serveRecentShares(w)
+	})
+	mux.HandleFunc(prefix+"thumbnail", func(w http.ResponseWriter, req *http.Request) {
+		// only shares from the history can be fetched, so that other local programs can't use this as a proxy
+		entry, ok := historyEntryByURL(req.URL.Query().Get("url"))
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		serveThumbnail(w, entry)
+	})
+	mux.HandleFunc(prefix+"copy", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		trayhost.SetClipboardText(req.PostFormValue("url"))
+		http.Redirect(w, req, prefix, http.StatusSeeOther)
+	})
+	mux.HandleFunc(prefix+"delete", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entry, ok := historyEntryByURL(req.PostFormValue("url"))
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		err := newClient().Delete(entry.URL, entry.DeleteToken)
+		if err != nil {
+			http.Error(w, "Failed to delete "+entry.URL+": "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		err = markDeletedInHistory(entry.URL)
+		if err != nil {
+			log.Println(err)
+		}
+		http.Redirect(w, req, prefix, http.StatusSeeOther)
+	})
+
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Println("Recent Shares server stopped:", err)
+	}()
+
+	recentSharesServer.url = "http://" + listener.Addr().String() + prefix
+}
+
+var recentSharesTemplate = template.Must(template.New("recent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Recent Shares</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 48em; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.4em; border-bottom: 1px solid #ddd; vertical-align: middle; }
+td.thumbnail { width: 64px; }
+img { max-width: 64px; max-height: 48px; }
+.deleted { color: #999; text-decoration: line-through; }
+.when { color: #777; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>Recent Shares</h1>
+{{if not .}}<p>Nothing has been shared yet.</p>{{end}}
+<table>
+{{range .}}<tr>
+<td class="thumbnail">{{if and .IsImage (not .Deleted)}}<img src="thumbnail?url={{.URL}}">{{end}}</td>
+<td{{if .Deleted}} class="deleted"{{end}}>{{.Name}}<br><a href="{{.URL}}" target="_blank">{{.URL}}</a></td>
+<td class="when">{{.Created.Format "Jan 2 15:04"}}</td>
+<td>{{if not .Deleted}}
+<form method="post" action="copy"><input type="hidden" name="url" value="{{.URL}}"><button>Copy Link</button></form>
+<form method="post" action="delete" onsubmit="return confirm('Delete this share from the server?')"><input type="hidden" name="url" value="{{.URL}}"><button>Delete</button></form>
+{{else}}Deleted{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func serveRecentShares(w http.ResponseWriter) {
+	entries, err := recentShares()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type recentShare struct {
+		historyEntry
+		IsImage bool
+	}
+	var shares []recentShare
+	for _, entry := range entries {
+		switch entry.Extension {
+		case "png", "jpg", "jpeg", "gif":
+			shares = append(shares, recentShare{historyEntry: entry, IsImage: true})
+		default:
+			shares = append(shares, recentShare{historyEntry: entry})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = recentSharesTemplate.Execute(w, shares)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// serveThumbnail serves a thumbnail of the shared image. It's fetched with the user's key, so that it doesn't use up
+// the share's downloads, and kept for the next time the page is shown.
+func serveThumbnail(w http.ResponseWriter, entry historyEntry) {
+	thumbnails.Lock()
+	b, cached := thumbnails.images[entry.URL]
+	thumbnails.Unlock()
+
+	if !cached {
+		var err error
+		b, err = newClient().Thumbnail(entry.URL, thumbnailWidth)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		thumbnails.Lock()
+		thumbnails.images[entry.URL] = b
+		thumbnails.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(b)
+}
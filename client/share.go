@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pavben/InstantShare/imageconv"
+	"github.com/pavben/InstantShare/upload"
+	"github.com/shurcooL/go/open"
+	"github.com/shurcooL/trayhost"
+)
+
+// shareJob is content being shared. It's prepared, its URL is put in the clipboard, and then it's uploaded in the background.
+// If anything fails, the failure notification offers to start over.
+type shareJob struct {
+	extension string
+	name      string
+	bytes     []byte
+	path      string
+	files     []string
+	thumbnail trayhost.Image
+}
+
+func newClient() *upload.Client {
+	cfg := currentConfig()
+	return &upload.Client{
+		Host: cfg.Host,
+		Key:  cfg.Key,
+		TTL:  time.Duration(cfg.TTL),
+	}
+}
+
+// start prepares the share and starts uploading it.
+func (job *shareJob) start() {
+	if len(job.files) > 1 {
+		job.startBundle()
+		return
+	}
+
+	log.Println("request URL")
+
+	client := newClient()
+	share, err := client.Prepare(job.extension, job.name)
+	if err != nil {
+		job.failed(err)
+		return
+	}
+
+	log.Println("display/put URL in clipboard")
+
+	if job.path != "" && job.thumbnail.Kind == "" {
+		job.thumbnail = fileThumbnail(job.extension, job.path)
+	}
+
+	job.remember(share, displayName(job.name, job.extension))
+	job.shared(share.URL, share.URL)
+
+	go func() {
+		var err error
+		if job.path != "" {
+			log.Println("upload file in background:", job.path)
+			err = uploadFile(client, share.URL, job.path)
+		} else {
+			log.Println("upload", job.extension, "in background of size", len(job.bytes))
+			err = uploadWithProgress(client, share.URL, bytes.NewReader(job.bytes), int64(len(job.bytes)), displayName(job.name, job.extension))
+		}
+		if err != nil {
+			job.failed(err)
+			return
+		}
+		job.completed(share.URL)
+	}()
+}
+
+// startBundle prepares a bundle for the files, whose URL shows a page listing them, and starts uploading them.
+func (job *shareJob) startBundle() {
+	client := newClient()
+	bundle, err := client.PrepareBundle()
+	if err != nil {
+		job.failed(err)
+		return
+	}
+
+	job.remember(bundle, fmt.Sprintf("%d files", len(job.files)))
+	job.shared(bundle.URL, fmt.Sprintf("%d files: %s", len(job.files), bundle.URL))
+
+	log.Println("upload", len(job.files), "files in background")
+
+	go func() {
+		for _, path := range job.files {
+			name := filepath.Base(path)
+			if isDirectory(path) {
+				name += ".zip"
+			}
+			err := uploadFile(client, upload.BundleFileURL(bundle.URL, name), path)
+			if err != nil {
+				job.failed(err)
+				return
+			}
+		}
+		job.completed(bundle.URL)
+	}()
+}
+
+// convertImage converts the copied image or screenshot to the format and size in the preferences, leaving out its metadata.
+// If it can't be converted, the user is told and it's shared as it is.
+func (job *shareJob) convertImage() {
+	cfg := currentConfig()
+	b, extension, err := imageconv.Convert(bytes.NewReader(job.bytes), imageconv.Options{
+		Format:   cfg.Image.Format,
+		Quality:  cfg.Image.Quality,
+		MaxWidth: cfg.Image.MaxWidth,
+	})
+	if err != nil {
+		log.Println("Failed to convert image:", err)
+		trayhost.Notification{
+			Title: "Image Not Converted",
+			Body:  err.Error() + "\nSharing the original " + strings.ToUpper(job.extension) + " image instead.",
+			Image: job.thumbnail,
+		}.Display()
+		return
+	}
+
+	job.bytes = b
+	job.extension = extension
+}
+
+// remember adds share to the history of recent shares, under name.
+func (job *shareJob) remember(share *upload.Share, name string) {
+	err := addToHistory(historyEntry{
+		URL:         share.URL,
+		DeleteToken: share.DeleteToken,
+		Name:        name,
+		Path:        job.path,
+		Extension:   job.extension,
+		Created:     time.Now(),
+	})
+	if err != nil {
+		log.Println("Failed to save history:", err)
+	}
+}
+
+// shared puts url in the clipboard and lets the user know, before the upload begins.
+func (job *shareJob) shared(url string, body string) {
+	trayhost.SetClipboardText(url)
+	if !currentConfig().Notifications.Shared {
+		return
+	}
+	trayhost.Notification{
+		Title:   "Success",
+		Body:    body,
+		Image:   job.thumbnail,
+		Timeout: 3 * time.Second,
+		Handler: func() {
+			// On click, open the displayed URL.
+			open.Open(url)
+		},
+	}.Display()
+}
+
+// completed lets the user know that the upload finished, so the link works for everyone.
+func (job *shareJob) completed(url string) {
+	log.Println("done")
+
+	if !currentConfig().Notifications.Completed {
+		return
+	}
+	trayhost.Notification{
+		Title:   "Upload Complete",
+		Body:    url,
+		Image:   job.thumbnail,
+		Timeout: 3 * time.Second,
+		Handler: func() {
+			open.Open(url)
+		},
+	}.Display()
+}
+
+// failed lets the user know that sharing failed. Clicking the notification shares the content again, with a new link.
+func (job *shareJob) failed(err error) {
+	log.Println(err)
+
+	trayhost.Notification{
+		Title: "Upload Failed",
+		Body:  err.Error() + "\nClick to retry.",
+		Handler: func() {
+			job.start()
+		},
+	}.Display()
+}
+
+// isDirectory returns true if path is a directory.
+func isDirectory(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// uploadFile uploads the file at path to shareURL. Directories are uploaded as zip archives, built while uploading.
+func uploadFile(client *upload.Client, shareURL string, path string) error {
+	if isDirectory(path) {
+		zipReader := upload.ZipDirectory(path)
+		defer zipReader.Close()
+
+		return uploadWithProgress(client, shareURL, zipReader, -1, filepath.Base(path)+".zip")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return uploadWithProgress(client, shareURL, f, fi.Size(), filepath.Base(path))
+}
@@ -0,0 +1,172 @@
+// Package imageconv converts images to the formats they're shared in, for the Instant Share clients and server.
+package imageconv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	stddraw "image/draw"
+	_ "image/gif" // for decoding
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff" // for decoding
+	_ "golang.org/x/image/webp" // for decoding
+)
+
+var (
+	// ErrUnknownFormat is returned by Convert when the output format isn't one it can encode.
+	ErrUnknownFormat = errors.New("unknown image format; use png, jpeg or webp")
+
+	// ErrNoWebPEncoder is returned by Convert when WebP output is requested but the cwebp tool isn't installed.
+	ErrNoWebPEncoder = errors.New("cwebp is needed to encode WebP images; install the webp package")
+
+	// ErrTooLarge is returned by Convert for images with more than MaxPixels pixels, which would take too much memory to decode.
+	ErrTooLarge = errors.New("image is too large to convert")
+)
+
+// MaxPixels is the largest number of pixels in an image that Convert decodes.
+const MaxPixels = 100 * 1000 * 1000
+
+// DefaultQuality is the JPEG and WebP quality used when Options.Quality is zero.
+const DefaultQuality = 90
+
+// Options describes the image that Convert produces.
+type Options struct {
+	Format   string // Output format: "png", "jpeg" or "webp".
+	Quality  int    // Quality of JPEG and WebP images, from 1 to 100. Zero means DefaultQuality.
+	MaxWidth int    // If non-zero, wider images are scaled down to this width, keeping their aspect ratio.
+}
+
+// Extension returns the file extension of images in format, like "jpg" for "jpeg", or "" if format is unknown.
+func Extension(format string) string {
+	switch format {
+	case "png", "webp":
+		return format
+	case "jpeg":
+		return "jpg"
+	default:
+		return ""
+	}
+}
+
+// Convert decodes the PNG, JPEG, GIF, TIFF or WebP image read from r and encodes it as described by opt.
+// Metadata, like the location a photo was taken at, is left out of the result. It returns the encoded image
+// along with its file extension.
+func Convert(r io.Reader, opt Options) ([]byte, string, error) {
+	ext := Extension(opt.Format)
+	if ext == "" {
+		return nil, "", ErrUnknownFormat
+	}
+	if opt.Quality == 0 {
+		opt.Quality = DefaultQuality
+	}
+
+	// read everything first, since the header is decoded twice
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+	m, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", err
+	}
+
+	m = scaleDown(m, opt.MaxWidth)
+
+	var buf bytes.Buffer
+	switch opt.Format {
+	case "png":
+		err = png.Encode(&buf, m)
+	case "jpeg":
+		err = jpeg.Encode(&buf, flatten(m), &jpeg.Options{Quality: opt.Quality})
+	case "webp":
+		err = encodeWebP(&buf, m, opt.Quality)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), ext, nil
+}
+
+// scaleDown returns m scaled down to maxWidth, or m itself if it's no wider or maxWidth is zero.
+func scaleDown(m image.Image, maxWidth int) image.Image {
+	bounds := m.Bounds()
+	if maxWidth <= 0 || bounds.Dx() <= maxWidth {
+		return m
+	}
+
+	height := bounds.Dy() * maxWidth / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, maxWidth, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), m, bounds, draw.Src, nil)
+	return scaled
+}
+
+// flatten draws m over a white background, since JPEG images can't be transparent.
+func flatten(m image.Image) image.Image {
+	if o, ok := m.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return m
+	}
+	flat := image.NewRGBA(image.Rect(0, 0, m.Bounds().Dx(), m.Bounds().Dy()))
+	stddraw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, stddraw.Src)
+	stddraw.Draw(flat, flat.Bounds(), m, m.Bounds().Min, stddraw.Over)
+	return flat
+}
+
+// encodeWebP encodes m as WebP with the cwebp tool, since Go has no WebP encoder.
+func encodeWebP(w io.Writer, m image.Image, quality int) error {
+	cwebp, err := exec.LookPath("cwebp")
+	if err != nil {
+		return ErrNoWebPEncoder
+	}
+
+	dir, err := ioutil.TempDir("", "instantshare")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "image.png"), filepath.Join(dir, "image.webp")
+
+	// PNG is lossless, so it's encoded quickly and only once lossily, by cwebp
+	var buf bytes.Buffer
+	err = (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, m)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(in, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command(cwebp, "-quiet", "-metadata", "none", "-q", fmt.Sprint(quality), in, "-o", out).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cwebp: %v: %s", err, bytes.TrimSpace(output))
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
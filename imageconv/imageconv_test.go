@@ -0,0 +1,67 @@
+package imageconv
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvert(t *testing.T) {
+	b, ext, err := Convert(bytes.NewReader(testPNG(t, 200, 100)), Options{Format: "jpeg", Quality: 80, MaxWidth: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != "jpg" {
+		t.Errorf("got extension %q, want jpg", ext)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 50 || config.Height != 25 {
+		t.Errorf("got %dx%d, want 50x25", config.Width, config.Height)
+	}
+
+	// images that are narrow enough keep their size
+	b, ext, err = Convert(bytes.NewReader(testPNG(t, 20, 10)), Options{Format: "png", MaxWidth: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = png.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != "png" || config.Width != 20 || config.Height != 10 {
+		t.Errorf("got %s %dx%d, want png 20x10", ext, config.Width, config.Height)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	_, _, err := Convert(bytes.NewReader(testPNG(t, 1, 1)), Options{Format: "bmp"})
+	if err != ErrUnknownFormat {
+		t.Errorf("got %v for an unknown format, want ErrUnknownFormat", err)
+	}
+
+	_, _, err = Convert(bytes.NewReader([]byte("not an image")), Options{Format: "png"})
+	if err == nil {
+		t.Error("got no error for content that isn't an image")
+	}
+}
@@ -0,0 +1,282 @@
+// isshare uploads files to an Instant Share server from the command line.
+//
+// Usage:
+//
+//	isshare [flags] file...
+//
+// The URL of each file is printed as soon as it's prepared, before its upload finishes, since downloads can begin
+// while uploads are in progress. Arguments may be glob patterns, and "-" uploads standard input, which is streamed
+// with chunked encoding when its length isn't known, like when it's a pipe. Directories are uploaded as zip archives,
+// which are built while uploading.
+//
+// With -capture, a screenshot is taken with the platform's screenshot tool and uploaded. Bind "isshare -capture"
+// to a hotkey in your desktop's keyboard settings to share screenshots with a single key press.
+//
+// With -bundle, the files are uploaded together as a bundle, whose URL shows a page listing them.
+//
+// The server and API key can be given in the INSTANTSHARE_HOST and INSTANTSHARE_KEY environment variables
+// instead of flags, which keeps the key out of process listings and CI logs.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pavben/InstantShare/capture"
+	"github.com/pavben/InstantShare/upload"
+)
+
+var hostFlag = flag.String("host", os.Getenv("INSTANTSHARE_HOST"), `Target server host, like "share.example.com". HTTPS is used unless another scheme is given, like "http://localhost:27080". Defaults to $INSTANTSHARE_HOST.`)
+var keyFlag = flag.String("key", "", "API key for the target server. Defaults to $INSTANTSHARE_KEY.")
+var ttlFlag = flag.Duration("ttl", 0, "If non-zero, shares expire after this long (e.g., 24h).")
+var nameFlag = flag.String("name", "", `Original file name to give standard input, when uploading "-".`)
+var extFlag = flag.String("ext", "txt", `File extension to give standard input, when uploading "-" without -name.`)
+var bundleFlag = flag.Bool("bundle", false, "Upload the files as a bundle with a single URL, which lists them and offers them as a zip.")
+var captureFlag = flag.Bool("capture", false, "Take a screenshot and upload it, instead of files.")
+var captureCommandFlag = flag.String("capture-command", "", `Command that takes a screenshot for -capture, like "maim -s", with the path of the PNG file to write appended. Defaults to the platform's screenshot tool.`)
+var quietFlag = flag.Bool("q", false, "Don't show upload progress.")
+
+// input is a file to upload.
+type input struct {
+	path      string // Path of the file, or "-" for standard input.
+	name      string // Original name of the file, or empty if it has none.
+	isDir     bool   // True if the file is a directory, which is uploaded as a zip archive.
+	extension string
+	share     *upload.Share
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: isshare [flags] file...")
+	fmt.Fprintln(os.Stderr, `Uploads files to an Instant Share server and prints their URLs. "-" uploads standard input.`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 && !*captureFlag {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *hostFlag == "" {
+		fmt.Fprintln(os.Stderr, "isshare: -host or $INSTANTSHARE_HOST is required")
+		os.Exit(2)
+	}
+	if *keyFlag == "" {
+		*keyFlag = os.Getenv("INSTANTSHARE_KEY")
+	}
+
+	client := &upload.Client{
+		Host: *hostFlag,
+		Key:  *keyFlag,
+		TTL:  *ttlFlag,
+	}
+
+	if *captureFlag {
+		err := captureAndUpload(client)
+		if err == capture.ErrCancelled {
+			return
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "isshare:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	files, err := expandArgs(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "isshare:", err)
+		os.Exit(1)
+	}
+
+	failed := false
+
+	if *bundleFlag {
+		err := prepareBundle(client, files)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "isshare:", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, f := range files {
+		// each file is prepared just before it's uploaded, since the server aborts prepared uploads that don't start soon
+		if f.share == nil {
+			f.share, err = client.Prepare(f.extension, f.name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "isshare: %s: %v\n", f.path, err)
+				failed = true
+				continue
+			}
+			fmt.Println(f.share.URL)
+		}
+
+		err := uploadFile(client, f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "isshare: %s: %v\n", f.path, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// captureAndUpload takes a screenshot, prints the URL it will have, and uploads it.
+func captureAndUpload(client *upload.Client) error {
+	b, err := capture.Screenshot(capture.ParseCommand(*captureCommandFlag))
+	if err != nil {
+		return err
+	}
+
+	share, err := client.Prepare("png", "")
+	if err != nil {
+		return err
+	}
+	fmt.Println(share.URL)
+
+	return client.Upload(share.URL, bytes.NewReader(b), int64(len(b)), nil)
+}
+
+// prepareBundle prepares a bundle for files, and prints its URL. The files are then uploaded to the bundle.
+func prepareBundle(client *upload.Client, files []*input) error {
+	names := make([]string, len(files))
+	seen := make(map[string]bool)
+	for i, f := range files {
+		names[i] = f.name
+		if names[i] == "" {
+			names[i] = "stdin." + f.extension
+		}
+		if seen[names[i]] {
+			return fmt.Errorf("%s: a bundle can't have two files named %q", f.path, names[i])
+		}
+		seen[names[i]] = true
+	}
+
+	bundle, err := client.PrepareBundle()
+	if err != nil {
+		return err
+	}
+
+	for i, f := range files {
+		f.share = &upload.Share{
+			URL:         upload.BundleFileURL(bundle.URL, names[i]),
+			DeleteToken: bundle.DeleteToken,
+		}
+	}
+
+	fmt.Println(bundle.URL)
+
+	return nil
+}
+
+// expandArgs returns the files named by args, expanding glob patterns. Shells usually expand them,
+// but not when they're quoted, or on Windows.
+func expandArgs(args []string) ([]*input, error) {
+	var files []*input
+
+	for _, arg := range args {
+		if arg == "-" {
+			name := *nameFlag
+			extension := *extFlag
+			if name != "" {
+				extension = strings.TrimPrefix(filepath.Ext(name), ".")
+			}
+			files = append(files, &input{path: arg, name: name, extension: extension})
+			continue
+		}
+
+		paths := []string{arg}
+		if strings.ContainsAny(arg, `*?[\`) {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%s: no matching files", arg)
+			}
+			paths = matches
+		}
+
+		for _, path := range paths {
+			fileInfo, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if fileInfo.IsDir() {
+				files = append(files, &input{
+					path:      path,
+					name:      filepath.Base(path) + ".zip",
+					isDir:     true,
+					extension: "zip",
+				})
+				continue
+			}
+
+			files = append(files, &input{
+				path:      path,
+				name:      filepath.Base(path),
+				extension: strings.ToLower(strings.TrimPrefix(filepath.Ext(path), ".")),
+			})
+		}
+	}
+
+	return files, nil
+}
+
+// uploadFile uploads f, which must have been prepared, showing its progress on standard error.
+func uploadFile(client *upload.Client, f *input) error {
+	var r io.Reader
+	var size int64 = -1
+
+	switch {
+	case f.isDir:
+		zipReader := upload.ZipDirectory(f.path)
+		defer zipReader.Close()
+
+		r = zipReader
+	case f.path == "-":
+		r = os.Stdin
+
+		// standard input redirected from a file has a known length, and can be resumed
+		if fileInfo, err := os.Stdin.Stat(); err == nil && fileInfo.Mode().IsRegular() {
+			size = fileInfo.Size()
+		}
+	default:
+		file, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		r = file
+		size = fileInfo.Size()
+	}
+
+	var progress func(sent int64)
+	if !*quietFlag && isTerminal(os.Stderr) {
+		bar := newProgressBar(os.Stderr, f.path, size)
+		defer bar.Finish()
+		progress = bar.Update
+	}
+
+	return client.Upload(f.share.URL, r, size, progress)
+}
+
+// isTerminal returns true if f is a terminal, rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	fileInfo, err := f.Stat()
+	return err == nil && fileInfo.Mode()&os.ModeCharDevice != 0
+}
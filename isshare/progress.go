@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pavben/InstantShare/upload"
+)
+
+// progressBarWidth is the number of characters between the brackets of a progress bar.
+const progressBarWidth = 30
+
+// progressBar draws the progress of an upload on a single terminal line.
+type progressBar struct {
+	w        io.Writer
+	name     string
+	total    int64 // -1 if unknown.
+	sent     int64
+	lastDraw time.Time
+
+	sync.Mutex
+}
+
+func newProgressBar(w io.Writer, name string, total int64) *progressBar {
+	return &progressBar{
+		w:     w,
+		name:  name,
+		total: total,
+	}
+}
+
+// Update records that sent bytes have been uploaded, and redraws the bar at most 10 times a second.
+func (pb *progressBar) Update(sent int64) {
+	pb.Lock()
+	defer pb.Unlock()
+
+	pb.sent = sent
+
+	if time.Since(pb.lastDraw) >= 100*time.Millisecond {
+		pb.draw()
+	}
+}
+
+// Finish draws the bar one last time, and moves to the next line.
+func (pb *progressBar) Finish() {
+	pb.Lock()
+	defer pb.Unlock()
+
+	pb.draw()
+	fmt.Fprintln(pb.w)
+}
+
+// draw redraws the bar over the current line. The caller must hold the lock.
+func (pb *progressBar) draw() {
+	pb.lastDraw = time.Now()
+
+	if pb.total <= 0 {
+		fmt.Fprintf(pb.w, "\r%s %s", pb.name, upload.FormatSize(pb.sent))
+		return
+	}
+
+	filled := int(pb.sent * progressBarWidth / pb.total)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+
+	fmt.Fprintf(pb.w, "\r%s [%s%s] %3d%% %s / %s", pb.name,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		pb.sent*100/pb.total, upload.FormatSize(pb.sent), upload.FormatSize(pb.total))
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"hash"
 	"io"
 	"log"
 	"os"
@@ -16,13 +19,30 @@ var (
 	errAlreadyUploading = errors.New("that file is already uploading or failed")
 	errNoPreparedUpload = errors.New("no prepared upload with this filename")
 	errUploadAborted    = errors.New("upload aborted")
+	errFileDeleted      = errors.New("file was deleted")
+	errUploadNotStarted = errors.New("upload has not started; use PUT")
+	errOffsetMismatch   = errors.New("Upload-Offset does not match the number of bytes received")
+	errUploadTooLong    = errors.New("upload is longer than its declared length")
+	errFileTooLarge     = errors.New("file exceeds the maximum file size")
+	errTooManyPrepared  = errors.New("too many prepared uploads haven't started; upload to them or wait for them to time out")
 )
 
 type activeFileManager struct {
-	activeFiles map[string]*activeFile
-	fileStore   fileStore
+	activeFiles       map[string]*activeFile
+	fileStore         fileStore
+	shares            *shareStore
+	maxFileSize       int           // Uploads of unknown length are aborted once they exceed this many bytes.
+	uploadIdleTimeout time.Duration // How long an upload may go without receiving data before it's aborted.
+	streamIdleTimeout time.Duration // Same, while a request with a body of unknown length is still sending it.
+	readBufferSize    int
+	maxPrepared       int // How many prepared uploads each API key may have that haven't started. Zero means unlimited.
+	quotas            quotas
 
 	sync.RWMutex
+
+	// Held while preparing a share, so that each one's record counts towards the quota checked by the next,
+	// without holding the lock, and holding up downloads and uploads, while the record is saved.
+	prepareMutex sync.Mutex
 }
 
 type activeFileState int
@@ -31,6 +51,7 @@ const (
 	activeFileStateNew activeFileState = iota
 	activeFileStateAborted
 	activeFileStateFinished
+	activeFileStateDeleted
 )
 
 type activeFile struct {
@@ -46,73 +67,402 @@ type activeFile struct {
 }
 
 type currentUpload struct {
-	bytesWritten   int
-	totalFileBytes int
+	bytesWritten   int // -1 until the file has been created in the fileStore.
+	totalFileBytes int // -1 while the length is unknown, until an upload sent with chunked encoding ends.
+	fileWriter     io.WriteCloser
+	hash           hash.Hash
+	receiving      bool  // True while a request is sending data for this upload.
+	maxBytes       int   // The upload is aborted with maxBytesErr once it exceeds this many bytes.
+	maxBytesErr    error // errFileTooLarge, or errQuotaExceeded if the uploader's quota is the limit.
 }
 
-func newActiveFileManager(fileStore fileStore) *activeFileManager {
+func newActiveFileManager(fileStore fileStore, shares *shareStore, maxFileSize int, uploadIdleTimeout time.Duration, streamIdleTimeout time.Duration, readBufferSize int, maxPrepared int, quotas quotas) *activeFileManager {
 	return &activeFileManager{
-		activeFiles: make(map[string]*activeFile),
-		fileStore:   fileStore,
+		activeFiles:       make(map[string]*activeFile),
+		fileStore:         fileStore,
+		shares:            shares,
+		maxFileSize:       maxFileSize,
+		uploadIdleTimeout: uploadIdleTimeout,
+		streamIdleTimeout: streamIdleTimeout,
+		readBufferSize:    readBufferSize,
+		maxPrepared:       maxPrepared,
+		quotas:            quotas,
 	}
 }
 
-func (afm *activeFileManager) PrepareUpload(fileExtension string, userKey string) (string, error) {
-	afm.Lock()
-	defer afm.Unlock()
+// PrepareUpload reserves a new filename for userKey to upload to, and persists record for it.
+// The record's Created time is filled in by PrepareUpload.
+func (afm *activeFileManager) PrepareUpload(fileExtension string, userKey string, record shareRecord) (string, error) {
+	afm.prepareMutex.Lock()
+	defer afm.prepareMutex.Unlock()
+
+	// the records that the quotas are checked against are loaded before taking the lock, if they're shared
+	afm.shares.refresh()
 
 	for {
-		fileName, err := id.Generate()
+		fileName, err := func() (string, error) {
+			afm.Lock()
+			defer afm.Unlock()
+
+			// every prepared upload takes memory and a goroutine until it times out
+			if afm.maxPrepared != 0 && afm.preparedCount(userKey) >= afm.maxPrepared {
+				return "", errTooManyPrepared
+			}
+
+			err := afm.quotas.check(afm.shares, record.Uploader, afm.uploadingBytes(record.Uploader), true)
+			if err != nil {
+				return "", err
+			}
+
+			for {
+				fileName, err := id.Generate()
+				if err != nil {
+					return "", err
+				}
+				if fileExtension != "" {
+					fileName += "." + fileExtension
+				}
+
+				_, exists := afm.activeFiles[fileName]
+				if !exists {
+					afm.addActiveFile(fileName, userKey)
+					return fileName, nil
+				}
+			}
+		}()
 		if err != nil {
 			return "", err
 		}
-		if fileExtension != "" {
-			fileName += "." + fileExtension
+
+		record.Created = time.Now()
+		err = afm.shares.Add(fileName, record)
+		if err == errShareExists {
+			// the name is taken by a share that isn't uploading here, like one prepared by another instance of the server
+			afm.abortPrepared(fileName)
+			continue
+		} else if err != nil {
+			afm.abortPrepared(fileName)
+			return "", err
 		}
 
-		_, exists := afm.activeFiles[fileName]
-		if !exists {
-			activeFile := &activeFile{
-				fileName:          fileName,
-				currentUpload:     nil,
-				readLocker:        nil,
-				dataAvailableCond: nil,
-				timeout:           nil,
-				userKey:           userKey,
-				state:             activeFileStateNew,
-			}
+		return fileName, nil
+	}
+}
 
-			activeFile.readLocker = activeFile.RLocker()
-			activeFile.dataAvailableCond = sync.NewCond(activeFile.readLocker)
-			activeFile.timeout = timeout.New(10*time.Second, func() {
-				afm.finishActiveFile(activeFile, fileName)
-			})
-			afm.activeFiles[fileName] = activeFile
+// PrepareBundle reserves a name for a new bundle, which files can then be added to with PrepareBundleFile,
+// and persists record for it. The record's Bundle and Created fields are filled in by PrepareBundle.
+func (afm *activeFileManager) PrepareBundle(record shareRecord) (string, error) {
+	afm.prepareMutex.Lock()
+	defer afm.prepareMutex.Unlock()
+
+	afm.RLock()
+	uploadingBytes := afm.uploadingBytes(record.Uploader)
+	afm.RUnlock()
+
+	err := afm.quotas.check(afm.shares, record.Uploader, uploadingBytes, false)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		bundleName, err := id.Generate()
+		if err != nil {
+			return "", err
+		}
+
+		if _, exists := afm.shares.Get(bundleName); exists {
+			continue
+		}
 
-			return fileName, nil
+		record.Bundle = true
+		record.Created = time.Now()
+		err = afm.shares.Add(bundleName, record)
+		if err == errShareExists {
+			continue
+		} else if err != nil {
+			return "", err
 		}
+
+		return bundleName, nil
 	}
 }
 
-func (afm *activeFileManager) finishActiveFile(activeFile *activeFile, fileName string) {
+// PrepareBundleFile adds a file with the given name to a bundle, and prepares it for userKey to upload.
+// It returns the name of the file in the fileStore, "<bundle name>/<name>".
+func (afm *activeFileManager) PrepareBundleFile(bundleName string, name string, userKey string) (string, error) {
+	afm.prepareMutex.Lock()
+	defer afm.prepareMutex.Unlock()
+
+	fileName := bundleName + "/" + name
+
+	afm.shares.refresh()
+
+	err := func() error {
+		afm.Lock()
+		defer afm.Unlock()
+
+		if _, exists := afm.activeFiles[fileName]; exists {
+			return errAlreadyUploading
+		}
+
+		bundle, _ := afm.shares.Get(bundleName)
+		err := afm.quotas.check(afm.shares, bundle.Uploader, afm.uploadingBytes(bundle.Uploader), true)
+		if err != nil {
+			return err
+		}
+
+		afm.addActiveFile(fileName, userKey)
+		return nil
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	err = afm.shares.AddBundleFile(bundleName, name, time.Now())
+	if err != nil {
+		afm.abortPrepared(fileName)
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+// abortPrepared forgets an upload that was prepared, but whose share record couldn't be added.
+// Nothing was uploaded, and the record may be another file's, so neither the file nor the record is removed.
+func (afm *activeFileManager) abortPrepared(fileName string) {
+	afm.Lock()
+	activeFile, exists := afm.activeFiles[fileName]
+	delete(afm.activeFiles, fileName)
+	afm.Unlock()
+
+	if exists {
+		activeFile.timeout.Cancel()
+	}
+}
+
+// Quota returns the user's usage of their storage quotas.
+func (afm *activeFileManager) Quota(userName string) quotaUsage {
+	afm.shares.refresh()
+
+	afm.RLock()
+	defer afm.RUnlock()
+
+	return afm.quotas.usage(afm.shares, userName, afm.uploadingBytes(userName))
+}
+
+// uploadingBytes returns how many bytes the user's uploads in progress take up: the length of those whose length
+// is known, and what has been received of the others. Their shares don't count their size until they finish,
+// so without this, uploads running at the same time could each use up all of the user's remaining quota.
+// The caller must hold the lock.
+func (afm *activeFileManager) uploadingBytes(userName string) int {
+	bytes := 0
+	for fileName, activeFile := range afm.activeFiles {
+		activeFile.RLock()
+		currentUpload := activeFile.currentUpload
+		if currentUpload != nil && activeFile.state == activeFileStateNew {
+			if record, _ := afm.shares.Get(fileName); record.Uploader == userName {
+				if currentUpload.totalFileBytes > currentUpload.bytesWritten {
+					bytes += currentUpload.totalFileBytes
+				} else if currentUpload.bytesWritten > 0 {
+					bytes += currentUpload.bytesWritten
+				}
+			}
+		}
+		activeFile.RUnlock()
+	}
+	return bytes
+}
+
+// preparedCount returns the number of prepared uploads for userKey that haven't started. The caller must hold the lock.
+func (afm *activeFileManager) preparedCount(userKey string) int {
+	count := 0
+	for _, activeFile := range afm.activeFiles {
+		activeFile.RLock()
+		if activeFile.userKey == userKey && activeFile.state == activeFileStateNew && activeFile.currentUpload == nil {
+			count++
+		}
+		activeFile.RUnlock()
+	}
+	return count
+}
+
+// addActiveFile starts tracking a newly prepared upload. The caller must hold the lock.
+func (afm *activeFileManager) addActiveFile(fileName string, userKey string) {
+	activeFile := &activeFile{
+		fileName:          fileName,
+		currentUpload:     nil,
+		readLocker:        nil,
+		dataAvailableCond: nil,
+		timeout:           nil,
+		userKey:           userKey,
+		state:             activeFileStateNew,
+	}
+
+	activeFile.readLocker = activeFile.RLocker()
+	activeFile.dataAvailableCond = sync.NewCond(activeFile.readLocker)
+	activeFile.timeout = timeout.New(afm.uploadIdleTimeout, func() {
+		err := afm.finishActiveFile(activeFile, fileName)
+		if err != nil {
+			log.Println("Failed to finish upload:", err)
+		}
+	})
+	afm.activeFiles[fileName] = activeFile
+}
+
+// finishActiveFile ends the upload of activeFile, unless it has already ended. If all of the file was received,
+// the file is kept and its share record updated; otherwise the file and the share record are removed.
+// The caller is responsible for cancelling activeFile.timeout, unless it's the one calling.
+func (afm *activeFileManager) finishActiveFile(activeFile *activeFile, fileName string) error {
+	var fileWriter io.WriteCloser
+	var finished bool
+	var size int
+	var sha256Sum []byte
+
 	activeFile.Lock()
 	{
-		if activeFile.currentUpload != nil && activeFile.currentUpload.bytesWritten == activeFile.currentUpload.totalFileBytes {
+		if activeFile.state != activeFileStateNew {
+			// already finished, aborted or deleted
+			activeFile.Unlock()
+			return nil
+		}
+
+		currentUpload := activeFile.currentUpload
+
+		if currentUpload != nil && currentUpload.bytesWritten == currentUpload.totalFileBytes {
 			activeFile.state = activeFileStateFinished
+			finished = true
+			size = currentUpload.bytesWritten
+			sha256Sum = currentUpload.hash.Sum(nil)
 		} else {
 			activeFile.state = activeFileStateAborted
 		}
 
+		if currentUpload != nil {
+			fileWriter = currentUpload.fileWriter
+			currentUpload.fileWriter = nil
+		}
+
 		activeFile.dataAvailableCond.Broadcast()
 	}
 	activeFile.Unlock()
 
 	afm.Lock()
-	delete(afm.activeFiles, fileName)
+	if afm.activeFiles[fileName] == activeFile {
+		delete(afm.activeFiles, fileName)
+	}
 	afm.Unlock()
+
+	var err error
+	if fileWriter != nil {
+		err = fileWriter.Close()
+	}
+
+	if finished && err == nil {
+		err = afm.shares.Update(fileName, func(record *shareRecord) {
+			record.Size = size
+			record.SHA256 = hex.EncodeToString(sha256Sum)
+			record.Uploaded = time.Now()
+		})
+		if record, _ := afm.shares.Get(fileName); err == nil && record.Expired {
+			// another instance of the server deleted the share, or removed it as expired, while it was uploading here,
+			// when there was no file to remove yet
+			err = removeFile(afm.fileStore, afm.shares, fileName)
+		}
+		return err
+	}
+
+	// an aborted upload leaves no file behind, so there's nothing left to expire
+	if fileWriter != nil {
+		removeErr := afm.fileStore.RemoveFile(fileName)
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Println("Failed to remove file of aborted upload:", removeErr)
+		}
+	}
+	removeErr := afm.shares.Remove(fileName)
+	if removeErr != nil {
+		log.Println("Failed to remove share record:", removeErr)
+	}
+
+	return err
+}
+
+// Delete takes down a share: it marks the share as expired so that it's reported as gone, aborts the upload
+// if one is in progress, failing any readers with errFileDeleted, and removes the file.
+// Deleting a bundle deletes all of its files.
+func (afm *activeFileManager) Delete(fileName string) error {
+	if record, exists := afm.shares.Get(fileName); exists && record.Bundle {
+		for _, name := range record.Files {
+			err := afm.Delete(fileName + "/" + name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// readers woken below look the share up, and must find it gone rather than not found
+	err := afm.shares.MarkExpired(fileName)
+	if err != nil {
+		return err
+	}
+
+	activeFile := func() *activeFile {
+		afm.Lock()
+		defer afm.Unlock()
+
+		activeFile, exists := afm.activeFiles[fileName]
+		if !exists {
+			return nil
+		}
+
+		delete(afm.activeFiles, fileName)
+
+		return activeFile
+	}()
+
+	if activeFile != nil {
+		activeFile.timeout.Cancel()
+
+		var fileWriter io.WriteCloser
+
+		activeFile.Lock()
+		activeFile.state = activeFileStateDeleted
+		if activeFile.currentUpload != nil {
+			fileWriter = activeFile.currentUpload.fileWriter
+			activeFile.currentUpload.fileWriter = nil
+		}
+		activeFile.dataAvailableCond.Broadcast()
+		activeFile.Unlock()
+
+		// if a request is sending data, it will notice the state change and stop
+		if fileWriter != nil {
+			fileWriter.Close()
+		}
+	}
+
+	return removeFile(afm.fileStore, afm.shares, fileName)
+}
+
+// IsActive returns true if fileName has been prepared, and its upload hasn't finished or been aborted yet.
+func (afm *activeFileManager) IsActive(fileName string) bool {
+	afm.RLock()
+	defer afm.RUnlock()
+
+	_, exists := afm.activeFiles[fileName]
+
+	return exists
 }
 
-func (afm *activeFileManager) Upload(fileName string, fileData io.ReadCloser, contentLength int, userKey string) (err error) {
+// Upload writes fileData to a file prepared by PrepareUpload, making it available to readers as it arrives.
+// Once the upload finishes, its contentType, size and hash are saved in the share's record.
+//
+// If contentLength is -1, the upload's length is unknown, and it ends when fileData reaches io.EOF.
+// Otherwise, if fileData ends early, the upload is not aborted until it has been idle for uploadIdleTimeout,
+// and can be continued with Resume in the meantime.
+func (afm *activeFileManager) Upload(fileName string, contentType string, fileData io.Reader, contentLength int, userKey string) error {
+	if afm.quotas.storageFull() {
+		return errStorageFull
+	}
+
 	// prepare upload
 	activeFile, err := func() (*activeFile, error) {
 		afm.Lock()
@@ -123,16 +473,38 @@ func (afm *activeFileManager) Upload(fileName string, fileData io.ReadCloser, co
 			return nil, errNoPreparedUpload
 		}
 
+		// the quota is checked under the lock, so that the upload's length is reserved before another upload
+		// of the user's can start
+		record, _ := afm.shares.Get(fileName)
+		uploadingBytes := afm.uploadingBytes(record.Uploader)
+
 		activeFile.Lock()
 		defer activeFile.Unlock()
 
+		if activeFile.userKey != userKey {
+			return nil, errUserKeyMismatch
+		}
+
 		if activeFile.currentUpload != nil {
 			return nil, errAlreadyUploading
 		}
 
+		// the uploader's quota may be less than the maximum file size
+		maxBytes, maxBytesErr := afm.maxFileSize, errFileTooLarge
+		if remaining := afm.quotas.remainingBytes(afm.shares, record.Uploader, uploadingBytes); remaining != -1 && remaining < maxBytes {
+			maxBytes, maxBytesErr = remaining, errQuotaExceeded
+		}
+		if contentLength > maxBytes {
+			return nil, maxBytesErr
+		}
+
 		activeFile.currentUpload = &currentUpload{
 			bytesWritten:   -1,
 			totalFileBytes: contentLength,
+			hash:           sha256.New(),
+			receiving:      true,
+			maxBytes:       maxBytes,
+			maxBytesErr:    maxBytesErr,
 		}
 		return activeFile, nil
 	}()
@@ -140,35 +512,129 @@ func (afm *activeFileManager) Upload(fileName string, fileData io.ReadCloser, co
 		return err
 	}
 
+	err = afm.shares.Update(fileName, func(record *shareRecord) {
+		record.ContentType = contentType
+	})
+	if err != nil {
+		activeFile.timeout.Cancel()
+		afm.finishActiveFile(activeFile, fileName)
+		return err
+	}
+
 	fileWriter, err := afm.fileStore.GetFileWriter(fileName)
 	if err != nil {
+		activeFile.timeout.Cancel()
+		afm.finishActiveFile(activeFile, fileName)
 		return err
 	}
 
-	defer func() {
-		fileWriter.Close()
+	// now that the file has been created, indicate that by setting bytesWritten to 0
+	err = func() error {
+		activeFile.Lock()
 
-		// If Upload failed and is returning a non-nil error, then remove the file we created here (inside GetFileWriter).
-		if err != nil {
+		defer activeFile.Unlock()
+
+		// the upload may have timed out or been deleted while the file was being created
+		if err := activeFile.stateError(); err != nil {
+			fileWriter.Close()
 			afm.fileStore.RemoveFile(fileName)
+			return err
 		}
 
-		activeFile.timeout.Cancel()
-		afm.finishActiveFile(activeFile, fileName)
+		activeFile.currentUpload.fileWriter = fileWriter
+		activeFile.currentUpload.bytesWritten = 0
+
+		return nil
 	}()
+	if err != nil {
+		return err
+	}
 
-	// now that the file has been created, indicate that by setting bytesWritten to 0
-	func() {
-		afm.Lock()
+	activeFile.dataAvailableCond.Broadcast()
 
-		defer afm.Unlock()
+	_, err = afm.receive(activeFile, fileName, fileData)
+	return err
+}
 
-		activeFile.currentUpload.bytesWritten = 0
+// Resume continues an upload that was interrupted, with fileData holding the rest of the file starting at offset.
+// It returns the number of bytes of the file received so far.
+func (afm *activeFileManager) Resume(fileName string, fileData io.Reader, offset int, userKey string) (int, error) {
+	activeFile, err := func() (*activeFile, error) {
+		afm.RLock()
+		defer afm.RUnlock()
+
+		activeFile, exists := afm.activeFiles[fileName]
+		if !exists {
+			return nil, errNoPreparedUpload
+		}
+
+		activeFile.Lock()
+		defer activeFile.Unlock()
+
+		if activeFile.userKey != userKey {
+			return nil, errUserKeyMismatch
+		}
+
+		currentUpload := activeFile.currentUpload
+
+		switch {
+		case currentUpload == nil || currentUpload.bytesWritten < 0:
+			return nil, errUploadNotStarted
+		case currentUpload.receiving:
+			return nil, errAlreadyUploading
+		case offset != currentUpload.bytesWritten:
+			return nil, errOffsetMismatch
+		}
+
+		currentUpload.receiving = true
+
+		return activeFile, nil
 	}()
+	if err != nil {
+		return 0, err
+	}
 
-	activeFile.dataAvailableCond.Broadcast()
+	activeFile.timeout.Reset()
+
+	return afm.receive(activeFile, fileName, fileData)
+}
+
+// UploadOffset returns the number of bytes of the file received so far, and its total length, or -1 if it's not known yet.
+func (afm *activeFileManager) UploadOffset(fileName string, userKey string) (int, int, error) {
+	afm.RLock()
+	activeFile, exists := afm.activeFiles[fileName]
+	afm.RUnlock()
 
-	buf := make([]byte, 250000)
+	if !exists {
+		return 0, 0, errNoPreparedUpload
+	}
+
+	activeFile.RLock()
+	defer activeFile.RUnlock()
+
+	if activeFile.userKey != userKey {
+		return 0, 0, errUserKeyMismatch
+	}
+
+	if activeFile.currentUpload == nil || activeFile.currentUpload.bytesWritten < 0 {
+		return 0, 0, errUploadNotStarted
+	}
+
+	return activeFile.currentUpload.bytesWritten, activeFile.currentUpload.totalFileBytes, nil
+}
+
+// receive writes fileData to activeFile's file until fileData ends, and finishes the upload if it's complete.
+// It returns the number of bytes of the file received so far.
+func (afm *activeFileManager) receive(activeFile *activeFile, fileName string, fileData io.Reader) (int, error) {
+	buf := make([]byte, afm.readBufferSize)
+
+	// a body of unknown length may come from a live source, like a log being followed, that goes quiet for a while
+	activeFile.RLock()
+	streaming := activeFile.currentUpload.totalFileBytes == -1
+	activeFile.RUnlock()
+	if streaming {
+		activeFile.timeout.SetDuration(afm.streamIdleTimeout)
+	}
 
 	for {
 		bytesRead, err := fileData.Read(buf)
@@ -176,35 +642,58 @@ func (afm *activeFileManager) Upload(fileName string, fileData io.ReadCloser, co
 		if bytesRead > 0 {
 			activeFile.timeout.Reset()
 
-			_, err := fileWriter.Write(buf[:bytesRead])
-			if err != nil {
-				return err
+			writeErr := activeFile.write(buf[:bytesRead])
+			switch writeErr {
+			case nil:
+				activeFile.dataAvailableCond.Broadcast()
+			case errUploadAborted, errFileDeleted:
+				// whoever ended the upload has cleaned up after it
+				return 0, writeErr
+			default:
+				activeFile.timeout.Cancel()
+				afm.finishActiveFile(activeFile, fileName)
+				return 0, writeErr
 			}
+		}
 
-			func() {
-				activeFile.Lock()
-				defer activeFile.Unlock()
+		if err == nil {
+			continue
+		}
 
-				activeFile.currentUpload.bytesWritten += bytesRead
-			}()
+		bytesWritten, complete := func() (int, bool) {
+			activeFile.Lock()
+			defer activeFile.Unlock()
 
-			activeFile.dataAvailableCond.Broadcast()
-		}
+			currentUpload := activeFile.currentUpload
+			currentUpload.receiving = false
 
-		if err != nil {
-			if err == io.EOF {
-				// done reading/writing
-				// save the file to the database and remove it from activeFileManager
+			// an upload of unknown length ends when its body does
+			if currentUpload.totalFileBytes == -1 && err == io.EOF {
+				currentUpload.totalFileBytes = currentUpload.bytesWritten
+			}
 
-				log.Println("Done uploading file")
+			return currentUpload.bytesWritten, currentUpload.bytesWritten == currentUpload.totalFileBytes
+		}()
 
-				// no need to remove it from activeFileManager since the timeout will do that
+		if complete {
+			log.Println("Done uploading file")
 
-				return nil
-			}
-			// non-EOF error
-			return err
+			activeFile.timeout.Cancel()
+			return bytesWritten, afm.finishActiveFile(activeFile, fileName)
+		}
+
+		if streaming {
+			// until the upload is resumed, it only has as long as any other
+			activeFile.timeout.SetDuration(afm.uploadIdleTimeout)
+		}
+
+		if err == io.EOF {
+			// the rest of the file will come in another request
+			return bytesWritten, nil
 		}
+
+		// the connection was probably lost; the upload can be resumed until it times out
+		return bytesWritten, err
 	}
 }
 
@@ -233,7 +722,7 @@ func (af *activeFile) GetReader(fileStore fileStore) fileReader {
 
 	defer af.readLocker.Unlock()
 
-	if af.state == activeFileStateAborted {
+	if af.state == activeFileStateAborted || af.state == activeFileStateDeleted {
 		return nil
 	}
 
@@ -241,7 +730,7 @@ func (af *activeFile) GetReader(fileStore fileStore) fileReader {
 	for af.currentUpload == nil || af.currentUpload.bytesWritten < 0 {
 		af.dataAvailableCond.Wait()
 
-		if af.state == activeFileStateAborted {
+		if af.state == activeFileStateAborted || af.state == activeFileStateDeleted {
 			return nil
 		}
 	}
@@ -257,6 +746,48 @@ func (af *activeFile) GetReader(fileStore fileStore) fileReader {
 	}
 }
 
+// write appends p to the file being uploaded, unless the upload has ended or would exceed its maximum size.
+func (af *activeFile) write(p []byte) error {
+	af.Lock()
+	defer af.Unlock()
+
+	if err := af.stateError(); err != nil {
+		return err
+	}
+
+	currentUpload := af.currentUpload
+
+	switch newBytesWritten := currentUpload.bytesWritten + len(p); {
+	case currentUpload.totalFileBytes != -1 && newBytesWritten > currentUpload.totalFileBytes:
+		return errUploadTooLong
+	case newBytesWritten > currentUpload.maxBytes:
+		return currentUpload.maxBytesErr
+	}
+
+	_, err := currentUpload.fileWriter.Write(p)
+	if err != nil {
+		return err
+	}
+
+	currentUpload.hash.Write(p)
+	currentUpload.bytesWritten += len(p)
+
+	return nil
+}
+
+// stateError returns the error readers should get if the upload will not complete, or nil.
+// The caller must hold at least a read lock.
+func (af *activeFile) stateError() error {
+	switch af.state {
+	case activeFileStateAborted:
+		return errUploadAborted
+	case activeFileStateDeleted:
+		return errFileDeleted
+	default:
+		return nil
+	}
+}
+
 type activeFileReader struct {
 	activeFile *activeFile
 	fileReader fileReader
@@ -269,7 +800,11 @@ func (afr *activeFileReader) ContentType() string {
 	return contentTypeFromFileName(afr.activeFile.fileName)
 }
 
+// Size returns the length of the file, or -1 if the upload's length is not known yet.
 func (afr *activeFileReader) Size() (int, error) {
+	afr.activeFile.readLocker.Lock()
+	defer afr.activeFile.readLocker.Unlock()
+
 	return afr.activeFile.currentUpload.totalFileBytes, nil
 }
 
@@ -305,22 +840,22 @@ func (afr *activeFileReader) Read(p []byte) (n int, err error) {
 	afr.activeFile.readLocker.Lock()
 	defer afr.activeFile.readLocker.Unlock()
 
-	if afr.activeFile.state == activeFileStateAborted {
-		return 0, errUploadAborted
-	}
-
-	// if done reading
-	// TODO: Maybe error if > totalFileBytes.
-	if afr.seekPos >= int64(afr.activeFile.currentUpload.totalFileBytes) {
-		return 0, io.EOF
+	if err := afr.activeFile.stateError(); err != nil {
+		return 0, err
 	}
 
 	// wait until there is more data to read
 	for afr.seekPos >= int64(afr.activeFile.currentUpload.bytesWritten) {
+		// if done reading; the length of an upload sent with chunked encoding becomes known when it ends
+		// TODO: Maybe error if > totalFileBytes.
+		if totalFileBytes := afr.activeFile.currentUpload.totalFileBytes; totalFileBytes != -1 && afr.seekPos >= int64(totalFileBytes) {
+			return 0, io.EOF
+		}
+
 		afr.activeFile.dataAvailableCond.Wait()
 
-		if afr.activeFile.state == activeFileStateAborted {
-			return 0, errUploadAborted
+		if err := afr.activeFile.stateError(); err != nil {
+			return 0, err
 		}
 	}
 
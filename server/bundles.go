@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// isBundle returns true if name is the name of a bundle.
+func isBundle(shares *shareStore, name string) bool {
+	record, exists := shares.Get(name)
+	return exists && record.Bundle
+}
+
+// handleBundleFile handles requests for the file with the given name in a bundle. Files are added to a bundle
+// by uploading them with PUT, which prepares them on the fly.
+func handleBundleFile(res http.ResponseWriter, req *http.Request, bundleName string, name string, activeFileManager *activeFileManager, fileStore fileStore, shares *shareStore, userKeys *userKeys, maxFileSize int64, publicURL string) {
+	bundle, exists := shares.Get(bundleName)
+	if !exists || !bundle.Bundle {
+		http.NotFound(res, req)
+		return
+	}
+	if bundle.isExpired(time.Now()) {
+		http.Error(res, "Gone", http.StatusGone)
+		return
+	}
+
+	fileName := bundleName + "/" + name
+
+	if req.Method == "PUT" {
+		userKey, err := userKeys.authenticate(req)
+		if err != nil {
+			unauthorized(res, err)
+			return
+		}
+		if userKeys.userName(userKey) != bundle.Uploader {
+			http.Error(res, "Forbidden: bundle was prepared by a different user", http.StatusForbidden)
+			return
+		}
+		if name == "." || name == ".." || strings.Contains(name, `\`) {
+			http.Error(res, "Bad Request: invalid file name", http.StatusBadRequest)
+			return
+		}
+		// a rejected upload mustn't leave the name taken, or a corrected retry would conflict with it
+		if !checkPutFile(res, req, maxFileSize) {
+			return
+		}
+
+		_, err = activeFileManager.PrepareBundleFile(bundleName, name, userKey)
+		if err != nil {
+			uploadError(res, err)
+			return
+		}
+	}
+
+	handleFile(res, req, fileName, activeFileManager, fileStore, shares, userKeys, maxFileSize, publicURL)
+}
+
+var bundleIndexTemplate = template.Must(template.New("bundle").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Shared files</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 40em; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.4em 0; border-bottom: 1px solid #ddd; }
+td.size { color: #777; text-align: right; }
+</style>
+</head>
+<body>
+<h1>Shared files</h1>
+<table>
+{{range .Files}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td class="size">{{.Size}}</td></tr>
+{{end}}</table>
+<p><a href="{{.ZipURL}}">Download all as .zip</a></p>
+</body>
+</html>
+`))
+
+// handleBundleIndex serves a page listing the files of a bundle at /<bundle name>/.
+// Viewing it doesn't count as a download of the bundle.
+func handleBundleIndex(res http.ResponseWriter, req *http.Request, bundleName string, shares *shareStore) {
+	// relative links on the page need the trailing slash
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		http.Redirect(res, req, "/"+bundleName+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	bundle, _ := shares.Get(bundleName)
+	if bundle.isExpired(time.Now()) {
+		http.Error(res, "Gone", http.StatusGone)
+		return
+	}
+
+	type indexFile struct {
+		Name string
+		URL  string
+		Size string
+	}
+	var files []indexFile
+
+	for _, name := range bundle.Files {
+		record, exists := shares.Get(bundleName + "/" + name)
+		if !exists || record.Expired {
+			continue
+		}
+
+		size := "uploading"
+		if !record.Uploaded.IsZero() {
+			size = formatSize(record.Size)
+		}
+
+		files = append(files, indexFile{
+			Name: name,
+			URL:  (&url.URL{Path: name}).String(),
+			Size: size,
+		})
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-cache")
+
+	err := bundleIndexTemplate.Execute(res, struct {
+		Files  []indexFile
+		ZipURL string
+	}{
+		Files:  files,
+		ZipURL: "../" + bundleName + ".zip",
+	})
+	if err != nil {
+		log.Println("Failed to render bundle index:", err)
+	}
+}
+
+// handleBundleZip streams all files of a bundle as a zip archive, which is built on the fly.
+// Files that are still uploading are included as they arrive. Only these downloads count towards the bundle's maximum number of downloads.
+func handleBundleZip(res http.ResponseWriter, req *http.Request, bundleName string, activeFileManager *activeFileManager, fileStore fileStore, shares *shareStore) {
+	bundle, _ := shares.Get(bundleName)
+	if bundle.isExpired(time.Now()) {
+		http.Error(res, "Gone", http.StatusGone)
+		return
+	}
+
+	if isDownloadStart(req) {
+		err := shares.CountDownload(bundleName, time.Now())
+		if err == errShareExpired {
+			http.Error(res, "Gone", http.StatusGone)
+			return
+		} else if err != nil {
+			log.Println("Failed to count download:", err)
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/zip")
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": bundleName + ".zip"}))
+	res.WriteHeader(http.StatusOK)
+
+	if req.Method == "HEAD" {
+		return
+	}
+
+	zipWriter := zip.NewWriter(res)
+
+	for _, name := range bundle.Files {
+		fileReader := getReaderForFileName(bundleName+"/"+name, activeFileManager, fileStore, shares)
+		if fileReader == nil {
+			// the file was deleted, or its upload was aborted
+			continue
+		}
+
+		err := func() error {
+			defer fileReader.Close()
+
+			// most shared files are already compressed, like images and videos, so they're stored as they are
+			fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     name,
+				Method:   zip.Store,
+				Modified: fileReader.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(fileWriter, fileReader)
+			return err
+		}()
+		if err != nil {
+			// the archive can't be finished properly; ending the response early lets the client know it's incomplete
+			log.Println("Failed to stream bundle:", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	err := zipWriter.Close()
+	if err != nil {
+		log.Println("Failed to stream bundle:", err)
+	}
+}
+
+// formatSize formats a number of bytes for people, like "12.3 MiB".
+func formatSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n) / unit
+	prefixes := "KMGTPE"
+	i := 0
+	for value >= unit && i < len(prefixes)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, prefixes[i])
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the server settings.
+//
+// Every setting is a command-line flag. Settings not given as flags are taken from environment variables named
+// INSTANTSHARE_<FLAG NAME> (e.g., INSTANTSHARE_MAX_FILE_SIZE for -max-file-size), and then from the config file.
+type config struct {
+	configPath string
+	genKey     string
+
+	listenAddr         string
+	host               string
+	tlsCertPath        string
+	tlsKeyPath         string
+	redirectListenAddr string
+	hstsMaxAge         time.Duration
+
+	userKeysPath   string
+	sharesPath     string
+	reapInterval   time.Duration
+	shareRetention time.Duration
+
+	storeType      string
+	storagePath    string
+	memoryCapacity byteSize
+	s3Endpoint     string
+	s3Region       string
+	s3Bucket       string
+	s3Prefix       string
+	s3SpoolPath    string
+	dedupIndexPath string
+
+	maxFileSize       byteSize
+	uploadIdleTimeout time.Duration
+	streamIdleTimeout time.Duration
+	readBufferSize    byteSize
+
+	userMaxBytes byteSize
+	userMaxFiles int
+	maxDiskUsage int
+
+	prepareRate    int
+	uploadRate     int
+	downloadRate   int
+	maxPrepared    int
+	clientIPHeader string
+}
+
+// loadConfig parses the command-line arguments, and fills in the rest of the settings from the environment and the config file.
+func loadConfig(args []string) (*config, error) {
+	cfg := &config{
+		memoryCapacity: 1024 * 1024 * 1024,
+		maxFileSize:    200 * 1024 * 1024,
+		readBufferSize: 250000,
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&cfg.configPath, "config", "", "Path to a config file with \"<flag name> = <value>\" lines. [section] headers prefix the names that follow with \"<section>-\".")
+	fs.StringVar(&cfg.genKey, "genkey", "", "Print a user keys file line with a new API key for the given user name, and exit.")
+
+	fs.StringVar(&cfg.listenAddr, "listen", ":27080", "Address to listen on.")
+	fs.StringVar(&cfg.host, "host", "", `Host the server is reached at, like "share.example.com", for links to shares in the pages it serves. HTTPS is assumed unless another scheme is given, like "http://localhost:27080". Defaults to the Host header of each request.`)
+	fs.StringVar(&cfg.tlsCertPath, "tls-cert", "", "Path to a PEM certificate (chain). If set along with -tls-key, the server speaks HTTPS. Send SIGHUP to reload it.")
+	fs.StringVar(&cfg.tlsKeyPath, "tls-key", "", "Path to the PEM private key of -tls-cert.")
+	fs.StringVar(&cfg.redirectListenAddr, "redirect-listen", "", `Address to listen on for plain HTTP requests to redirect to HTTPS, like ":80".`)
+	fs.DurationVar(&cfg.hstsMaxAge, "hsts-max-age", 365*24*time.Hour, "Value of max-age in Strict-Transport-Security headers sent over HTTPS. 0 disables the header.")
+	fs.StringVar(&cfg.userKeysPath, "userkeys", "userkeys", "Path to the file with API keys of users allowed to upload.")
+	fs.StringVar(&cfg.sharesPath, "shares", "shares.json", "Path to the file where share metadata is kept. With -store=s3, it's kept in the bucket instead, and the file is only read to copy it there the first time.")
+	fs.DurationVar(&cfg.reapInterval, "reap-interval", time.Minute, "How often to look for expired shares to remove.")
+	fs.DurationVar(&cfg.shareRetention, "share-retention", 7*24*time.Hour, "How long to remember shares that expired or were deleted, so that they're reported as gone rather than not found.")
+
+	fs.StringVar(&cfg.storeType, "store", "disk", `Where to store uploaded files: "disk", "memory" or "s3".`)
+	fs.StringVar(&cfg.storagePath, "storage", "files", "Directory for uploaded files, when -store=disk.")
+	fs.Var(&cfg.memoryCapacity, "memory-capacity", "Maximum total size of stored files, when -store=memory. Least recently used files are evicted to stay under it.")
+	fs.StringVar(&cfg.s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "Base URL of the S3-compatible service, when -store=s3.")
+	fs.StringVar(&cfg.s3Region, "s3-region", "us-east-1", "Region of the S3 bucket, when -store=s3.")
+	fs.StringVar(&cfg.s3Bucket, "s3-bucket", "", "Name of the S3 bucket, when -store=s3. Credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	fs.StringVar(&cfg.s3Prefix, "s3-prefix", "", "Prefix for the keys of stored objects, when -store=s3.")
+	fs.StringVar(&cfg.s3SpoolPath, "s3-spool", "spool", "Directory for files that are still uploading, when -store=s3.")
+	fs.StringVar(&cfg.dedupIndexPath, "dedup-index", "dedup.json", "Path to the file where the contents of stored files are indexed, so that files with the same contents are stored once. Empty disables deduplication, which -store=memory doesn't use. With -store=s3, the index is kept in the bucket instead, and the file is only read to copy it there the first time.")
+
+	fs.Var(&cfg.maxFileSize, "max-file-size", "Maximum size of an uploaded file, like 200MiB.")
+	fs.DurationVar(&cfg.uploadIdleTimeout, "upload-idle-timeout", 10*time.Second, "How long a prepared upload may go without receiving data before it's aborted.")
+	fs.DurationVar(&cfg.streamIdleTimeout, "stream-idle-timeout", time.Hour, "How long an upload of unknown length may go without receiving data while its request is still connected, as when following a log that goes quiet.")
+	fs.Var(&cfg.readBufferSize, "read-buffer-size", "Size of the buffer used to read each upload.")
+
+	fs.Var(&cfg.userMaxBytes, "user-max-bytes", "Maximum total size of each user's shares, like 10GiB. 0 means unlimited.")
+	fs.IntVar(&cfg.userMaxFiles, "user-max-files", 0, "Maximum number of files each user may have shared at once. 0 means unlimited.")
+	fs.IntVar(&cfg.maxDiskUsage, "max-disk-usage", 95, "Percentage of the storage volume's space in use above which uploads are refused. 0 disables the check.")
+
+	fs.IntVar(&cfg.prepareRate, "prepare-rate", 60, "Uploads each client IP address and each user may prepare per minute. 0 means unlimited.")
+	fs.IntVar(&cfg.uploadRate, "upload-rate", 120, "Upload requests each client IP address and each user may make per minute. 0 means unlimited.")
+	fs.IntVar(&cfg.downloadRate, "download-rate", 600, "Download requests each client IP address may make per minute. 0 means unlimited.")
+	fs.IntVar(&cfg.maxPrepared, "max-prepared", 20, "Prepared uploads each user may have that haven't started. 0 means unlimited.")
+	fs.StringVar(&cfg.clientIPHeader, "client-ip-header", "", "Header that a reverse proxy puts the client's IP address in, like X-Forwarded-For. Rate limits apply to the last address in it.")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	isSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		isSet[f.Name] = true
+	})
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(configEnvName(f.Name))
+		if !ok || isSet[f.Name] || err != nil {
+			return
+		}
+		err = fs.Set(f.Name, value)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", configEnvName(f.Name), err)
+		}
+		isSet[f.Name] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.configPath != "" {
+		entries, err := readConfigFile(cfg.configPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if fs.Lookup(entry.name) == nil || entry.name == "config" {
+				return nil, fmt.Errorf("%s:%d: unknown setting %q", cfg.configPath, entry.lineNumber, entry.name)
+			}
+			if isSet[entry.name] {
+				continue
+			}
+			err := fs.Set(entry.name, entry.value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", cfg.configPath, entry.lineNumber, err)
+			}
+		}
+	}
+
+	if (cfg.tlsCertPath == "") != (cfg.tlsKeyPath == "") {
+		return nil, fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+	if cfg.redirectListenAddr != "" && cfg.tlsCertPath == "" {
+		return nil, fmt.Errorf("redirect-listen requires tls-cert and tls-key")
+	}
+	if cfg.prepareRate < 0 || cfg.uploadRate < 0 || cfg.downloadRate < 0 || cfg.maxPrepared < 0 {
+		return nil, fmt.Errorf("rate limits and max-prepared can't be negative")
+	}
+	if cfg.maxDiskUsage < 0 || cfg.maxDiskUsage > 100 {
+		return nil, fmt.Errorf("max-disk-usage must be a percentage from 0 to 100")
+	}
+	if cfg.readBufferSize < 1 {
+		return nil, fmt.Errorf("read-buffer-size must be positive")
+	}
+
+	return cfg, nil
+}
+
+// publicURL returns the base URL of the server set by -host, like "https://share.example.com", or "" if it isn't set.
+func (cfg *config) publicURL() string {
+	host := strings.TrimSuffix(cfg.host, "/")
+	if host != "" && !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return host
+}
+
+// configEnvName returns the name of the environment variable for the flag with name flagName.
+func configEnvName(flagName string) string {
+	return "INSTANTSHARE_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+type configEntry struct {
+	name       string
+	value      string
+	lineNumber int
+}
+
+// readConfigFile reads a config file made of "name = value" lines, where values may be quoted strings, and "#" starts a comment.
+// Names that follow a "[section]" line are prefixed with "section-". This makes simple TOML files valid config files.
+func readConfigFile(path string) ([]configEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []configEntry
+	var section string
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			closeIdx := strings.Index(line, "]")
+			if closeIdx == -1 {
+				return nil, fmt.Errorf("%s:%d: expected \"[section]\"", path, lineNumber)
+			}
+			if rest := strings.TrimSpace(line[closeIdx+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("%s:%d: unexpected %q after section header", path, lineNumber, rest)
+			}
+			section = strings.TrimSpace(line[1:closeIdx])
+			continue
+		}
+
+		equalsIdx := strings.Index(line, "=")
+		if equalsIdx == -1 {
+			return nil, fmt.Errorf("%s:%d: expected \"name = value\"", path, lineNumber)
+		}
+
+		name := strings.TrimSpace(line[:equalsIdx])
+		if section != "" {
+			name = section + "-" + name
+		}
+
+		value := strings.TrimSpace(line[equalsIdx+1:])
+		if strings.HasPrefix(value, `"`) {
+			value, err = strconv.QuotedPrefix(value)
+			if err == nil {
+				value, err = strconv.Unquote(value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value", path, lineNumber)
+			}
+		} else if commentIdx := strings.Index(value, "#"); commentIdx != -1 {
+			value = strings.TrimSpace(value[:commentIdx])
+		}
+
+		entries = append(entries, configEntry{
+			name:       name,
+			value:      value,
+			lineNumber: lineNumber,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// byteSize is a number of bytes that can be set from strings like "200MiB", "1.5GB" or "4096".
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	// longer suffixes must come first so that, e.g., "MiB" isn't mistaken for "B"
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func (bs *byteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+
+	multiplier := 1.0
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.multiplier
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+
+	*bs = byteSize(n * multiplier)
+	return nil
+}
+
+func (bs *byteSize) String() string {
+	return strconv.FormatInt(int64(*bs), 10)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.toml")
+	err := ioutil.WriteFile(configPath, []byte(`
+# comments and blank lines are ignored
+listen = ":8080"
+host = "share.example.com/"
+max-file-size = "1GiB"
+upload-idle-timeout = 30s # trailing comment
+storage = "/var/lib/instantshare # not a comment"
+
+[s3] # section comment
+bucket = "shares"
+region = "eu-west-1"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// environment variables override the config file, and flags override both
+	os.Setenv("INSTANTSHARE_S3_REGION", "us-west-2")
+	os.Setenv("INSTANTSHARE_LISTEN", ":9090")
+	defer os.Unsetenv("INSTANTSHARE_S3_REGION")
+	defer os.Unsetenv("INSTANTSHARE_LISTEN")
+
+	cfg, err := loadConfig([]string{"-config", configPath, "-listen", ":7070"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.listenAddr != ":7070" {
+		t.Errorf("got listenAddr %q, want %q", cfg.listenAddr, ":7070")
+	}
+	if cfg.s3Region != "us-west-2" {
+		t.Errorf("got s3Region %q, want %q", cfg.s3Region, "us-west-2")
+	}
+	if cfg.s3Bucket != "shares" {
+		t.Errorf("got s3Bucket %q, want %q", cfg.s3Bucket, "shares")
+	}
+	if cfg.storagePath != "/var/lib/instantshare # not a comment" {
+		t.Errorf("got storagePath %q", cfg.storagePath)
+	}
+	if cfg.maxFileSize != 1<<30 {
+		t.Errorf("got maxFileSize %d, want %d", cfg.maxFileSize, 1<<30)
+	}
+	if cfg.uploadIdleTimeout != 30*time.Second {
+		t.Errorf("got uploadIdleTimeout %v, want %v", cfg.uploadIdleTimeout, 30*time.Second)
+	}
+	if got, want := cfg.publicURL(), "https://share.example.com"; got != want {
+		t.Errorf("got publicURL %q, want %q", got, want)
+	}
+	if cfg.readBufferSize != 250000 {
+		t.Errorf("got readBufferSize %d, want the default of 250000", cfg.readBufferSize)
+	}
+
+	err = ioutil.WriteFile(configPath, []byte("no-such-setting = 1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig([]string{"-config", configPath})
+	if err == nil {
+		t.Error("got no error for an unknown setting")
+	}
+}
@@ -12,6 +12,10 @@ func contentTypeFromFileName(fileName string) string {
 		return "video/mp4"
 	}
 	contentType := mime.TypeByExtension(ext)
+	if contentType == "" && isPasteFile(fileName) {
+		// source code in languages the system doesn't know, which would otherwise be downloaded
+		return "text/plain; charset=utf-8"
+	}
 	if contentType == "" {
 		return "application/octet-stream"
 	}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errFileContentsShared = errors.New("file can't be overwritten, since other files share its contents")
+)
+
+// blobsDir is the directory of the underlying store that contents are moved to when the file holding them
+// is removed while other files still have them. Share names never start with an underscore.
+const blobsDir = "_blobs"
+
+// dedupFileStore stores files with the same contents only once, in another fileStore.
+//
+// Files are written to the underlying store under their own names as usual, so that they can be read while
+// they're uploading. Once a file is complete, its contents are hashed: the first file with a given SHA-256
+// holds the contents for all files with it, and copies written later are removed. If the file holding
+// the contents is removed while other files have them, the contents are moved to "_blobs/<SHA-256>",
+// so that the name is free to be written again. The contents are removed once the last file with them is.
+//
+// If other instances of the server share the index, each change is made to the latest index, and made again if
+// another instance saves it first. Files are only removed once the index no longer refers to them.
+type dedupFileStore struct {
+	fileStore fileStore
+	storage   stateStorage // Where the index is kept.
+	version   string       // Version of the index in the storage.
+	refreshed time.Time    // When the index was last loaded or saved.
+
+	index struct {
+		Files map[string]string     // File name -> SHA-256 of its contents.
+		Blobs map[string]*dedupBlob // SHA-256 -> where the contents are stored.
+	}
+	storedIn map[string]string // Name of a file holding the contents of a blob -> its SHA-256.
+
+	sync.Mutex
+}
+
+// dedupBlob is contents shared by one or more files.
+type dedupBlob struct {
+	FileName string // Name of the file in the underlying store that holds the contents: the first one written with them, or one in blobsDir.
+	Refs     int    // Number of files with these contents.
+}
+
+func newDedupFileStore(fileStore fileStore, storage stateStorage) (*dedupFileStore, error) {
+	dfs := &dedupFileStore{
+		fileStore: fileStore,
+		storage:   storage,
+	}
+
+	dfs.Lock()
+	defer dfs.Unlock()
+
+	err := dfs.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// indexes written before contents were moved to blobsDir may have contents held by files that were removed
+	misplaced := func(sum string, blob *dedupBlob) bool {
+		return dfs.index.Files[blob.FileName] != sum && !strings.HasPrefix(blob.FileName, blobsDir+"/")
+	}
+	moved := false
+	for sum, blob := range dfs.index.Blobs {
+		moved = moved || misplaced(sum, blob)
+	}
+	if moved {
+		err := dfs.change(func() ([]string, error) {
+			var removals []string
+			for sum, blob := range dfs.index.Blobs {
+				if misplaced(sum, blob) {
+					removed, err := dfs.moveToBlobsDir(sum, blob)
+					if err != nil {
+						return nil, err
+					}
+					removals = append(removals, removed)
+				}
+			}
+			return removals, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dfs, nil
+}
+
+func (dfs *dedupFileStore) GetFileReader(fileName string) (fileReader, error) {
+	dfs.Lock()
+	defer dfs.Unlock()
+
+	dfs.refresh()
+
+	sum, indexed := dfs.index.Files[fileName]
+	if !indexed {
+		if _, isStorage := dfs.storedIn[fileName]; isStorage {
+			// contents moved to blobsDir are only read through the files that have them
+			return nil, &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+		}
+		// a file that's still being written, or one written before deduplication was enabled
+		return dfs.fileStore.GetFileReader(fileName)
+	}
+
+	storedFileName := dfs.index.Blobs[sum].FileName
+
+	fileReader, err := dfs.fileStore.GetFileReader(storedFileName)
+	if err != nil {
+		return nil, err
+	}
+	if storedFileName == fileName {
+		return fileReader, nil
+	}
+
+	// the type is guessed from the name of the file, rather than that of the file holding the contents
+	return &dedupFileReader{
+		fileReader:  fileReader,
+		contentType: contentTypeFromFileName(fileName),
+	}, nil
+}
+
+func (dfs *dedupFileStore) GetFileWriter(fileName string) (io.WriteCloser, error) {
+	dfs.Lock()
+	defer dfs.Unlock()
+
+	dfs.refresh()
+
+	if _, indexed := dfs.index.Files[fileName]; indexed {
+		err := dfs.remove(fileName)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, isStorage := dfs.storedIn[fileName]; isStorage {
+		// writing it would overwrite the contents of other files
+		return nil, errFileContentsShared
+	}
+
+	fileWriter, err := dfs.fileStore.GetFileWriter(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupFileWriter{
+		fileStore:  dfs,
+		fileName:   fileName,
+		fileWriter: fileWriter,
+		hash:       sha256.New(),
+	}, nil
+}
+
+func (dfs *dedupFileStore) RemoveFile(fileName string) error {
+	dfs.Lock()
+	defer dfs.Unlock()
+
+	dfs.refresh()
+
+	if _, indexed := dfs.index.Files[fileName]; !indexed {
+		if _, isStorage := dfs.storedIn[fileName]; isStorage {
+			return &os.PathError{Op: "remove", Path: fileName, Err: os.ErrNotExist}
+		}
+		return dfs.fileStore.RemoveFile(fileName)
+	}
+
+	return dfs.remove(fileName)
+}
+
+// remove forgets about a file in the index, and removes its contents if no other file has them.
+// If the file holds contents that other files have, they're moved to blobsDir. The caller must hold the lock.
+func (dfs *dedupFileStore) remove(fileName string) error {
+	return dfs.change(func() ([]string, error) {
+		sum, indexed := dfs.index.Files[fileName]
+		if !indexed {
+			// removed by another instance of the server in the meantime
+			return nil, nil
+		}
+		blob := dfs.index.Blobs[sum]
+
+		if blob.Refs == 1 {
+			delete(dfs.index.Files, fileName)
+			delete(dfs.index.Blobs, sum)
+			delete(dfs.storedIn, blob.FileName)
+			return []string{blob.FileName}, nil
+		}
+
+		var removals []string
+		if blob.FileName == fileName {
+			removed, err := dfs.moveToBlobsDir(sum, blob)
+			if err != nil {
+				return nil, err
+			}
+			removals = append(removals, removed)
+		}
+
+		delete(dfs.index.Files, fileName)
+		blob.Refs--
+		return removals, nil
+	})
+}
+
+// moveToBlobsDir copies the contents to a file in blobsDir named after their SHA-256, since the file that holds them
+// is being removed while other files still have them. It returns the name of that file, for change to remove
+// once the index no longer refers to it. The caller must hold the lock.
+func (dfs *dedupFileStore) moveToBlobsDir(sum string, blob *dedupBlob) (string, error) {
+	blobFileName := blobsDir + "/" + sum
+
+	err := dfs.copyFile(blob.FileName, blobFileName)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	// if the contents were gone already, as when a memory store evicted them, the next file written with them holds them
+
+	log.Println("Moved the contents of", blob.FileName, "to", blobFileName)
+
+	fileName := blob.FileName
+	delete(dfs.storedIn, blob.FileName)
+	blob.FileName = blobFileName
+	dfs.storedIn[blobFileName] = sum
+
+	return fileName, nil
+}
+
+// copyFile copies a file in the underlying store. The caller must hold the lock.
+func (dfs *dedupFileStore) copyFile(from string, to string) error {
+	fileReader, err := dfs.fileStore.GetFileReader(from)
+	if err != nil {
+		return err
+	}
+	defer fileReader.Close()
+
+	fileWriter, err := dfs.fileStore.GetFileWriter(to)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fileWriter, fileReader)
+	if closeErr := fileWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		dfs.fileStore.RemoveFile(to)
+		return err
+	}
+
+	return nil
+}
+
+// add records that the file that was just written has contents with the given SHA-256.
+// If another file already has them, the file is removed from the underlying store.
+func (dfs *dedupFileStore) add(fileName string, sum string) error {
+	dfs.Lock()
+	defer dfs.Unlock()
+
+	return dfs.change(func() ([]string, error) {
+		var removals []string
+
+		blob, exists := dfs.index.Blobs[sum]
+		if exists && !dfs.isStored(blob.FileName) {
+			// the contents are gone from the underlying store, like a memory store evicting them, so the new file holds them instead
+			delete(dfs.storedIn, blob.FileName)
+			blob.FileName = fileName
+			dfs.storedIn[fileName] = sum
+		} else if exists {
+			removals = append(removals, fileName)
+			log.Println("Stored", fileName, "as a duplicate of", blob.FileName)
+		} else {
+			blob = &dedupBlob{FileName: fileName}
+			dfs.index.Blobs[sum] = blob
+			dfs.storedIn[fileName] = sum
+		}
+
+		blob.Refs++
+		dfs.index.Files[fileName] = sum
+		return removals, nil
+	})
+}
+
+// isStored returns true if the underlying store has the file. The caller must hold the lock.
+func (dfs *dedupFileStore) isStored(fileName string) bool {
+	fileReader, err := dfs.fileStore.GetFileReader(fileName)
+	if err != nil {
+		return false
+	}
+	fileReader.Close()
+	return true
+}
+
+// change calls changeFunc, saves the index, and then removes the files that changeFunc returns from the underlying
+// store. If other instances of the server share the index, changeFunc is called with the latest index, and called
+// again if another instance saves it first. The caller must hold the lock.
+func (dfs *dedupFileStore) change(changeFunc func() ([]string, error)) error {
+	for {
+		if dfs.storage.Shared() {
+			err := dfs.load()
+			if err != nil {
+				return err
+			}
+		}
+
+		removals, err := changeFunc()
+		if err != nil {
+			// the index may hold part of the change, so a shared one is loaded again in full
+			dfs.version = ""
+			return err
+		}
+
+		b, err := json.MarshalIndent(dfs.index, "", "\t")
+		if err != nil {
+			return err
+		}
+
+		version, err := dfs.storage.Save(b, dfs.version)
+		if err == errStateChanged {
+			continue
+		} else if err != nil {
+			dfs.version = ""
+			return err
+		}
+		dfs.version = version
+		dfs.refreshed = time.Now()
+
+		for _, fileName := range removals {
+			err := dfs.fileStore.RemoveFile(fileName)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// load replaces the index with the one in the storage, unless it hasn't changed since it was last loaded or saved.
+// The caller must hold the lock.
+func (dfs *dedupFileStore) load() error {
+	b, version, err := dfs.storage.Load(dfs.version)
+	if err == errStateUnchanged {
+		dfs.refreshed = time.Now()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dfs.index.Files = make(map[string]string)
+	dfs.index.Blobs = make(map[string]*dedupBlob)
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &dfs.index)
+		if err != nil {
+			return err
+		}
+	}
+
+	dfs.storedIn = make(map[string]string)
+	for sum, blob := range dfs.index.Blobs {
+		dfs.storedIn[blob.FileName] = sum
+	}
+
+	dfs.version = version
+	dfs.refreshed = time.Now()
+	return nil
+}
+
+// refresh loads the index again if other instances of the server share it, and it was last loaded or saved
+// more than sharedStateMaxAge ago. The caller must hold the lock.
+func (dfs *dedupFileStore) refresh() {
+	if !dfs.storage.Shared() || time.Since(dfs.refreshed) < sharedStateMaxAge {
+		return
+	}
+
+	err := dfs.load()
+	if err != nil {
+		log.Println("Failed to load the dedup index:", err)
+	}
+}
+
+type dedupFileWriter struct {
+	fileStore  *dedupFileStore
+	fileName   string
+	fileWriter io.WriteCloser
+	hash       hash.Hash
+	closed     bool
+
+	// an upload that's deleted is closed while it may still be written to
+	sync.Mutex
+}
+
+func (dfw *dedupFileWriter) Write(p []byte) (int, error) {
+	dfw.Lock()
+	defer dfw.Unlock()
+
+	n, err := dfw.fileWriter.Write(p)
+	dfw.hash.Write(p[:n])
+	return n, err
+}
+
+func (dfw *dedupFileWriter) Close() error {
+	dfw.Lock()
+	defer dfw.Unlock()
+
+	err := dfw.fileWriter.Close()
+	if err != nil || dfw.closed {
+		return err
+	}
+	dfw.closed = true
+
+	return dfw.fileStore.add(dfw.fileName, hex.EncodeToString(dfw.hash.Sum(nil)))
+}
+
+// dedupFileReader reads a file whose contents are held by a file with another name.
+type dedupFileReader struct {
+	fileReader
+	contentType string
+}
+
+func (dfr *dedupFileReader) ContentType() string {
+	return dfr.contentType
+}
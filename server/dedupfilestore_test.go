@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupFileStore(t *testing.T) {
+	memoryFileStore := newMemoryFileStore(0)
+	indexPath := filepath.Join(t.TempDir(), "dedup.json")
+
+	fileStore, err := newDedupFileStore(memoryFileStore, &fileStateStorage{path: indexPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(fileName string, data string) {
+		fileWriter, err := fileStore.GetFileWriter(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fileWriter.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fileWriter.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(fileName string) (string, string, bool) {
+		fileReader, err := fileStore.GetFileReader(fileName)
+		if err != nil {
+			return "", "", false
+		}
+		defer fileReader.Close()
+		b, err := ioutil.ReadAll(fileReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b), fileReader.ContentType(), true
+	}
+	isStored := func(fileName string) bool {
+		fileReader, err := memoryFileStore.GetFileReader(fileName)
+		if err != nil {
+			return false
+		}
+		fileReader.Close()
+		return true
+	}
+
+	write("a.png", "same")
+	write("b.jpg", "same")
+	write("c.png", "different")
+
+	if isStored("b.jpg") {
+		t.Error("duplicate file was stored")
+	}
+	if data, contentType, ok := read("b.jpg"); !ok || data != "same" || contentType != "image/jpeg" {
+		t.Errorf("duplicate file: got %q %q %v, want %q image/jpeg", data, contentType, ok, "same")
+	}
+
+	// the index is kept across restarts
+	fileStore, err = newDedupFileStore(memoryFileStore, &fileStateStorage{path: indexPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the file that holds the contents keeps them for the duplicate
+	err = fileStore.RemoveFile("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := read("a.png"); ok {
+		t.Error("removed file can still be read")
+	}
+	if isStored("a.png") || !isStored(blobsDir+"/"+sha256Hex("same")) {
+		t.Error("contents weren't moved out of the removed file's name")
+	}
+	if data, _, ok := read("b.jpg"); !ok || data != "same" {
+		t.Errorf("duplicate after removing the original: got %q %v, want %q", data, ok, "same")
+	}
+
+	// the name of the removed file can be written again without touching the duplicate's contents
+	write("a.png", "new")
+	if data, _, ok := read("a.png"); !ok || data != "new" {
+		t.Errorf("file written again: got %q %v, want %q", data, ok, "new")
+	}
+	if data, _, ok := read("b.jpg"); !ok || data != "same" {
+		t.Errorf("duplicate after writing the original's name again: got %q %v, want %q", data, ok, "same")
+	}
+	err = fileStore.RemoveFile("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isStored("a.png") {
+		t.Error("file written again wasn't removed")
+	}
+
+	// the contents go with the last file that has them
+	err = fileStore.RemoveFile("b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isStored(blobsDir + "/" + sha256Hex("same")) {
+		t.Error("contents weren't removed along with the last file that had them")
+	}
+	if data, _, ok := read("c.png"); !ok || data != "different" {
+		t.Errorf("other file: got %q %v, want %q", data, ok, "different")
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSharedDedupIndex(t *testing.T) {
+	oldMaxAge := sharedStateMaxAge
+	sharedStateMaxAge = 50 * time.Millisecond
+	defer func() { sharedStateMaxAge = oldMaxAge }()
+
+	// like instances of the server sharing a bucket
+	memoryFileStore := newMemoryFileStore(0)
+	storage := &sharedStateStorage{}
+	a, err := newDedupFileStore(memoryFileStore, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newDedupFileStore(memoryFileStore, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(fileStore fileStore, fileName string, data string) {
+		fileWriter, err := fileStore.GetFileWriter(fileName)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, err = fileWriter.Write([]byte(data))
+		if err != nil {
+			t.Error(err)
+		}
+		err = fileWriter.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	read := func(fileStore fileStore, fileName string) (string, bool) {
+		fileReader, err := fileStore.GetFileReader(fileName)
+		if err != nil {
+			return "", false
+		}
+		defer fileReader.Close()
+		b, err := ioutil.ReadAll(fileReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b), true
+	}
+	isStored := func(fileName string) bool {
+		fileReader, err := memoryFileStore.GetFileReader(fileName)
+		if err != nil {
+			return false
+		}
+		fileReader.Close()
+		return true
+	}
+
+	// files written through both stores at once are stored once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fileStore := a
+			if i%2 == 1 {
+				fileStore = b
+			}
+			write(fileStore, fmt.Sprintf("%d.txt", i), "same")
+		}(i)
+	}
+	wg.Wait()
+
+	stored := 0
+	for i := 0; i < 10; i++ {
+		if isStored(fmt.Sprintf("%d.txt", i)) {
+			stored++
+		}
+	}
+	if stored != 1 {
+		t.Errorf("got %d copies of the contents stored, want 1", stored)
+	}
+
+	// each store sees files removed through the other once its index is old enough to be loaded again
+	for i := 0; i < 9; i++ {
+		err := a.RemoveFile(fmt.Sprintf("%d.txt", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := read(b, "0.txt"); ok {
+		t.Error("file removed through the other store can still be read")
+	}
+	if data, ok := read(b, "9.txt"); !ok || data != "same" {
+		t.Errorf("last file with the contents: got %q %v, want %q", data, ok, "same")
+	}
+
+	err = b.RemoveFile("9.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isStored(blobsDir+"/"+sha256Hex("same")) || isStored("9.txt") {
+		t.Error("contents weren't removed along with the last file that had them")
+	}
+}
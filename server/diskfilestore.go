@@ -13,18 +13,20 @@ var (
 	errFileTooBig = errors.New("File too big")
 )
 
-const basePath = "files"
-
-type diskFileStore struct{}
+type diskFileStore struct {
+	basePath string
+}
 
-func newDiskFileStore() (fileStore, error) {
-	fileStore := &diskFileStore{}
+func newDiskFileStore(basePath string) (fileStore, error) {
+	fileStore := &diskFileStore{
+		basePath: basePath,
+	}
 
 	_, err := os.Stat(basePath)
 
 	// if failed to stat, create the dir
 	if err != nil {
-		err = os.Mkdir(basePath, 0700)
+		err = os.MkdirAll(basePath, 0700)
 	}
 
 	// if failed to stat and failed to create dir, fail
@@ -50,7 +52,15 @@ func (dfs *diskFileStore) GetFileReader(fileName string) (fileReader, error) {
 }
 
 func (dfs *diskFileStore) GetFileWriter(fileName string) (io.WriteCloser, error) {
-	file, err := os.Create(dfs.fileNameToPath(fileName))
+	path := dfs.fileNameToPath(fileName)
+
+	// files of bundles are kept in a directory per bundle
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path)
 	if err != nil {
 		return nil, err
 	}
@@ -63,11 +73,23 @@ func (dfs *diskFileStore) GetFileWriter(fileName string) (io.WriteCloser, error)
 }
 
 func (dfs *diskFileStore) RemoveFile(fileName string) error {
-	return os.Remove(dfs.fileNameToPath(fileName))
+	path := dfs.fileNameToPath(fileName)
+
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	// remove the directory of a bundle along with its last file; this fails harmlessly if it's not empty
+	if dir := filepath.Dir(path); dir != filepath.Clean(dfs.basePath) {
+		os.Remove(dir)
+	}
+
+	return nil
 }
 
 func (dfs *diskFileStore) fileNameToPath(fileName string) string {
-	return filepath.Join(basePath, fileName)
+	return filepath.Join(dfs.basePath, fileName)
 }
 
 type diskFileReader struct {
@@ -0,0 +1,12 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package main
+
+import "errors"
+
+// diskUsage returns the fraction of the volume holding path that's in use, from 0 to 1.
+// It's not implemented on this platform, so the volume is never considered full.
+func diskUsage(path string) (float64, error) {
+	return 0, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,21 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package main
+
+import "syscall"
+
+// diskUsage returns the fraction of the volume holding path that's in use, from 0 to 1.
+// Space reserved for the superuser counts as used, as it can't be written to by the server.
+func diskUsage(path string) (float64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+
+	return 1 - float64(stat.Bavail)/float64(stat.Blocks), nil
+}
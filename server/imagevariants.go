@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pavben/InstantShare/imageconv"
+)
+
+// maxVariantWidth is the widest that image variants can be requested.
+const maxVariantWidth = 4096
+
+// variantsDir is the directory of the fileStore that image variants are kept in. Share names never start with
+// an underscore, and paths this deep aren't served, so variants can only be reached through their originals.
+const variantsDir = "_variants"
+
+var (
+	errNotAnImage    = errors.New("variants can only be made of images")
+	errNoShareRecord = errors.New("variants can't be made of files shared before share records were kept")
+)
+
+// variantSourceFormats are the formats that image variants are made in by default, by the extension of the original.
+// Originals in formats the server can't encode get PNG variants.
+var variantSourceFormats = map[string]string{
+	".png":  "png",
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".gif":  "png",
+	".tiff": "png",
+	".webp": "webp",
+}
+
+// imageVariant is a resized or converted copy of an image share, requested with the w and format query parameters.
+type imageVariant struct {
+	width  int    // Zero means the width of the original.
+	format string // Format that imageconv encodes.
+}
+
+// parseImageVariant returns the image variant requested for the file, or nil if the original was requested.
+func parseImageVariant(req *http.Request, fileName string) (*imageVariant, error) {
+	query := req.URL.Query()
+	if query.Get("w") == "" && query.Get("format") == "" {
+		return nil, nil
+	}
+
+	sourceFormat, isImage := variantSourceFormats[path.Ext(fileName)]
+	if !isImage {
+		return nil, errNotAnImage
+	}
+
+	variant := &imageVariant{format: sourceFormat}
+	if w := query.Get("w"); w != "" {
+		width, err := strconv.Atoi(w)
+		if err != nil || width < 1 || width > maxVariantWidth {
+			return nil, fmt.Errorf("w must be a width between 1 and %d", maxVariantWidth)
+		}
+		variant.width = width
+	}
+	if format := query.Get("format"); format != "" {
+		if imageconv.Extension(format) == "" {
+			return nil, imageconv.ErrUnknownFormat
+		}
+		variant.format = format
+	}
+
+	return variant, nil
+}
+
+// fileName returns the name that the variant of the original's file is kept under in the fileStore.
+func (variant *imageVariant) fileName(originalFileName string) string {
+	size := "full"
+	if variant.width != 0 {
+		size = "w" + strconv.Itoa(variant.width)
+	}
+	return variantsDir + "/" + originalFileName + "/" + size + "." + imageconv.Extension(variant.format)
+}
+
+// maxConcurrentVariants is how many variants may be made at once. Decoding a large image takes a lot of memory.
+const maxConcurrentVariants = 2
+
+// variantSlots holds a value for each variant being made, limiting them to maxConcurrentVariants.
+var variantSlots = make(chan struct{}, maxConcurrentVariants)
+
+// variantCalls are the variants being made, by file name, so that requests for a variant that's being made
+// wait for the result instead of making it again.
+var variantCalls = struct {
+	calls map[string]*variantCall
+	sync.Mutex
+}{calls: make(map[string]*variantCall)}
+
+type variantCall struct {
+	done chan struct{} // Closed once the variant is made.
+	err  error
+}
+
+// makeVariantOnce calls makeVariant, unless it's already being called for the same variant, in which case
+// it waits for that call to return instead.
+func makeVariantOnce(variantFileName string, makeVariant func() error) error {
+	variantCalls.Lock()
+	if call, exists := variantCalls.calls[variantFileName]; exists {
+		variantCalls.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &variantCall{done: make(chan struct{})}
+	variantCalls.calls[variantFileName] = call
+	variantCalls.Unlock()
+
+	variantSlots <- struct{}{}
+	call.err = makeVariant()
+	<-variantSlots
+
+	variantCalls.Lock()
+	delete(variantCalls.calls, variantFileName)
+	variantCalls.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+// serveImageVariant serves the variant of the original image. Variants are made when they're first requested,
+// and kept in the fileStore for later requests until the share is deleted or expires.
+func serveImageVariant(res http.ResponseWriter, req *http.Request, fileName string, variant *imageVariant, original fileReader, fileStore fileStore, shares *shareStore) {
+	variantFileName := variant.fileName(fileName)
+
+	if _, exists := shares.Get(fileName); !exists {
+		// files shared before shares had records have nowhere to keep track of their variants,
+		// and making them on every request would be too costly
+		imageVariantError(res, variantFileName, errNoShareRecord)
+		return
+	}
+
+	openVariant := func() fileReader {
+		record, _ := shares.Get(fileName)
+		for _, name := range record.Variants {
+			if name == variantFileName {
+				// the fileStore may have evicted it since, as the memory store does
+				variantReader, err := fileStore.GetFileReader(variantFileName)
+				if err != nil {
+					return nil
+				}
+				return variantReader
+			}
+		}
+		return nil
+	}
+
+	variantReader := openVariant()
+	if variantReader == nil {
+		err := makeVariantOnce(variantFileName, func() error {
+			// the variant may have been made since it was looked for
+			if variantReader := openVariant(); variantReader != nil {
+				variantReader.Close()
+				return nil
+			}
+			return makeImageVariant(fileName, variantFileName, variant, original, fileStore, shares)
+		})
+		if err != nil {
+			imageVariantError(res, variantFileName, err)
+			return
+		}
+
+		variantReader, err = fileStore.GetFileReader(variantFileName)
+		if err != nil {
+			log.Println("Failed to read image variant:", err)
+			http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	defer variantReader.Close()
+
+	res.Header().Set("Content-Type", variantReader.ContentType())
+	http.ServeContent(res, req, "", variantReader.ModTime(), variantReader)
+}
+
+// imageVariantError responds to a request for an image variant that couldn't be made.
+func imageVariantError(res http.ResponseWriter, variantFileName string, err error) {
+	log.Println("Failed to make image variant", variantFileName+":", err)
+
+	switch err {
+	case errShareExpired:
+		http.Error(res, "Gone", http.StatusGone)
+	case errNoShareRecord:
+		http.Error(res, "Not Found: "+err.Error(), http.StatusNotFound)
+	case imageconv.ErrNoWebPEncoder:
+		http.Error(res, "Not Implemented: this server can't encode WebP images", http.StatusNotImplemented)
+	case imageconv.ErrTooLarge:
+		http.Error(res, "Unprocessable Entity: image is too large to convert", http.StatusUnprocessableEntity)
+	default:
+		http.Error(res, "Unprocessable Entity: image could not be converted", http.StatusUnprocessableEntity)
+	}
+}
+
+// makeImageVariant converts the original image and stores the result under variantFileName,
+// adding it to the share's record so that it's removed along with the share.
+func makeImageVariant(fileName string, variantFileName string, variant *imageVariant, original fileReader, fileStore fileStore, shares *shareStore) error {
+	started := time.Now()
+
+	b, _, err := imageconv.Convert(original, imageconv.Options{Format: variant.format, MaxWidth: variant.width})
+	if err != nil {
+		return err
+	}
+
+	fileWriter, err := fileStore.GetFileWriter(variantFileName)
+	if err != nil {
+		return err
+	}
+	_, err = fileWriter.Write(b)
+	if closeErr := fileWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fileStore.RemoveFile(variantFileName)
+		return err
+	}
+
+	var expired bool
+	err = shares.Update(fileName, func(record *shareRecord) {
+		expired = record.Expired
+		for _, name := range record.Variants {
+			if name == variantFileName {
+				// made again after the fileStore evicted it
+				return
+			}
+		}
+		if !expired {
+			record.Variants = append(record.Variants, variantFileName)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if expired {
+		// the share was deleted while the variant was being made, and its files were removed without it
+		fileStore.RemoveFile(variantFileName)
+		return errShareExpired
+	}
+
+	log.Println("Made image variant", variantFileName, "of", len(b), "bytes in", time.Since(started))
+
+	return nil
+}
+
+// removeFile removes the share's file from the fileStore, along with any image variants made of it.
+func removeFile(fileStore fileStore, shares *shareStore, fileName string) error {
+	err := fileStore.RemoveFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	record, _ := shares.Get(fileName)
+	for _, variantFileName := range record.Variants {
+		err := fileStore.RemoveFile(variantFileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
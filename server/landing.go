@@ -0,0 +1,167 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unfurlUserAgents are parts of the User-Agent headers of bots that fetch links posted in chats to preview them.
+// Not all of them send Accept: text/html.
+var unfurlUserAgents = []string{
+	"Slackbot",
+	"Discordbot",
+	"Twitterbot",
+	"facebookexternalhit",
+	"Mattermost",
+	"TelegramBot",
+	"WhatsApp",
+	"LinkedInBot",
+	"SkypeUriPreview",
+	"redditbot",
+}
+
+// wantsLandingPage returns true if the request is from a browser or a link preview bot, which get a page showing the file
+// instead of the file itself. Embeds, like <img> and <video> elements, and clients like curl get the file,
+// as do requests with the raw query parameter.
+func wantsLandingPage(req *http.Request, contentType string) bool {
+	if req.URL.Query().Get("raw") != "" {
+		return false
+	}
+	if strings.HasPrefix(contentType, "text/html") {
+		// web pages are shown as they are
+		return false
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		return true
+	}
+	return isUnfurlBot(req)
+}
+
+// isUnfurlBot returns true if the request is from a bot fetching a link to preview it in a chat.
+func isUnfurlBot(req *http.Request) bool {
+	userAgent := req.Header.Get("User-Agent")
+	for _, bot := range unfurlUserAgents {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<meta property="og:title" content="{{.Name}}">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:site_name" content="Instant Share">
+{{if and .Preview (eq .Kind "image")}}<meta property="og:type" content="website">
+<meta property="og:image" content="{{.RawURL}}">
+<meta property="og:image:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:image" content="{{.RawURL}}">
+{{else if and .Preview (eq .Kind "video")}}<meta property="og:type" content="video.other">
+<meta property="og:video" content="{{.RawURL}}">
+<meta property="og:video:secure_url" content="{{.RawURL}}">
+<meta property="og:video:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary">
+{{else if and .Preview (eq .Kind "audio")}}<meta property="og:type" content="music.song">
+<meta property="og:audio" content="{{.RawURL}}">
+<meta property="og:audio:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary">
+{{else}}<meta property="og:type" content="website">
+<meta property="og:description" content="{{.Size}}">
+<meta name="twitter:card" content="summary">
+{{end}}<meta name="twitter:title" content="{{.Name}}">
+<style>
+body { font-family: sans-serif; margin: 0; background: #222; color: #eee; text-align: center; }
+main { padding: 1em; }
+img, video { max-width: 100%; max-height: calc(100vh - 6em); }
+audio { width: 100%; max-width: 40em; margin: 4em 0; }
+.file { font-size: 4em; margin: 1em 0 0.2em; }
+footer { padding: 0.6em 1em; }
+footer .size { color: #999; margin: 0 1em; }
+a { color: #8cf; }
+</style>
+</head>
+<body>
+<main>
+{{if eq .Kind "image"}}<a href="{{.RawURL}}"><img src="{{.RawURL}}" alt="{{.Name}}"></a>
+{{else if eq .Kind "video"}}<video src="{{.RawURL}}" controls autoplay muted playsinline></video>
+{{else if eq .Kind "audio"}}<audio src="{{.RawURL}}" controls></audio>
+{{else}}<div class="file">&#128196;</div>
+{{end}}</main>
+<footer>{{.Name}}<span class="size">{{.Size}}</span><a href="{{.RawURL}}" download="{{.Name}}">Download</a></footer>
+</body>
+</html>
+`))
+
+// serveLandingPage serves a page showing the file, with metadata that chats use to preview links to it.
+// Viewing it doesn't count as a download; loading the file it shows does. Since a bot fetching the file for
+// a preview would use up a download too, shares with a download limit get a preview of their name and size only.
+func serveLandingPage(res http.ResponseWriter, req *http.Request, fileName string, fileReader fileReader, publicURL string) {
+	contentType := fileReader.ContentType()
+
+	kind := "file"
+	for _, prefix := range []string{"image", "video", "audio"} {
+		if strings.HasPrefix(contentType, prefix+"/") {
+			kind = prefix
+		}
+	}
+
+	size := "uploading"
+	if n, err := fileReader.Size(); err == nil && n != -1 {
+		size = formatSize(n)
+	}
+
+	preview := true
+	if shareFileReader, ok := fileReader.(*shareFileReader); ok && shareFileReader.Record().MaxDownloads > 0 {
+		preview = false
+	}
+
+	baseURL := publicURL
+	if baseURL == "" {
+		baseURL = requestBaseURL(req)
+	}
+	pageURL := baseURL + (&url.URL{Path: "/" + fileName}).String()
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-cache")
+
+	err := landingTemplate.Execute(res, struct {
+		Name        string
+		Kind        string
+		ContentType string
+		Size        string
+		Preview     bool
+		URL         string
+		RawURL      string
+	}{
+		Name:        displayFileName(fileName, fileReader),
+		Kind:        kind,
+		ContentType: contentType,
+		Size:        size,
+		Preview:     preview,
+		URL:         pageURL,
+		RawURL:      pageURL + "?raw=1",
+	})
+	if err != nil {
+		log.Println("Failed to render landing page:", err)
+	}
+}
+
+// requestBaseURL returns the URL of the server that the request was made to, like "https://share.example.com".
+// Link previews need absolute URLs.
+func requestBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
@@ -2,108 +2,660 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
-)
+	"time"
 
-const maxFileSize = 200 * 1024 * 1024
+	"github.com/pavben/InstantShare/server/s3"
+)
 
 func main() {
-	fileStore, err := newDiskFileStore()
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if cfg.genKey != "" {
+		userKey, err := generateToken()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(cfg.genKey, userKey)
+		return
+	}
+
+	userKeys, err := loadUserKeys(cfg.userKeysPath)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	activeFileManager := newActiveFileManager(fileStore)
+	fileStore, err := newFileStore(cfg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	webHandler := getWebHandler(activeFileManager, fileStore)
+	sharesStorage, err := newStateStorage(cfg, cfg.sharesPath, "shares.json")
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	err = http.ListenAndServe(":27080", webHandler)
+	shares, err := newShareStore(sharesStorage)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Println(err)
+		return
+	}
+
+	activeFileManager := newActiveFileManager(fileStore, shares, int(cfg.maxFileSize), cfg.uploadIdleTimeout, cfg.streamIdleTimeout, int(cfg.readBufferSize), cfg.maxPrepared, newQuotas(cfg))
+
+	go reapExpiredShares(activeFileManager, shares, fileStore, cfg.reapInterval, cfg.shareRetention)
+
+	webHandler := getWebHandler(activeFileManager, fileStore, shares, userKeys, int64(cfg.maxFileSize), newRateLimits(cfg), cfg.publicURL())
+
+	if cfg.tlsCertPath == "" {
+		err = http.ListenAndServe(cfg.listenAddr, webHandler)
+		if err != nil {
+			log.Fatal("ListenAndServe: ", err)
+		}
+		return
+	}
+
+	certReloader, err := newCertReloader(cfg.tlsCertPath, cfg.tlsKeyPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if cfg.hstsMaxAge > 0 {
+		webHandler = hstsHandler(webHandler, cfg.hstsMaxAge)
+	}
+
+	if cfg.redirectListenAddr != "" {
+		go func() {
+			err := http.ListenAndServe(cfg.redirectListenAddr, httpsRedirectHandler(cfg.listenAddr))
+			if err != nil {
+				log.Fatal("ListenAndServe: ", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:    cfg.listenAddr,
+		Handler: webHandler,
+		TLSConfig: &tls.Config{
+			GetCertificate: certReloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+
+	err = server.ListenAndServeTLS("", "")
+	if err != nil {
+		log.Fatal("ListenAndServeTLS: ", err)
 	}
 }
 
-func getWebHandler(activeFileManager *activeFileManager, fileStore fileStore) http.Handler {
+// newQuotas returns the storage quotas set by cfg. The storage volume is watched if it's on this machine.
+func newQuotas(cfg *config) quotas {
+	q := quotas{
+		maxUserBytes: int(cfg.userMaxBytes),
+		maxUserFiles: cfg.userMaxFiles,
+		maxDiskUsage: cfg.maxDiskUsage,
+	}
+
+	switch cfg.storeType {
+	case "disk":
+		q.storagePath = cfg.storagePath
+	case "s3":
+		// uploads are spooled to disk before they're sent to S3
+		q.storagePath = cfg.s3SpoolPath
+	}
+	if q.storagePath != "" {
+		if _, err := diskUsage(q.storagePath); err != nil {
+			log.Println("Not watching disk usage:", err)
+			q.storagePath = ""
+		}
+	}
+
+	return q
+}
+
+func newFileStore(cfg *config) (fileStore, error) {
+	var fileStore fileStore
+	var err error
+
+	switch cfg.storeType {
+	case "disk":
+		fileStore, err = newDiskFileStore(cfg.storagePath)
+	case "memory":
+		// the files are gone when the server restarts, while the index of their contents would remain
+		return newMemoryFileStore(int64(cfg.memoryCapacity)), nil
+	case "s3":
+		if cfg.s3Bucket == "" {
+			return nil, errors.New("-s3-bucket is required when -store=s3")
+		}
+		fileStore, err = newS3FileStore(newS3Client(cfg), cfg.s3Prefix, cfg.s3SpoolPath)
+	default:
+		return nil, fmt.Errorf("unknown store type %q", cfg.storeType)
+	}
+	if err != nil || cfg.dedupIndexPath == "" {
+		return fileStore, err
+	}
+
+	dedupStorage, err := newStateStorage(cfg, cfg.dedupIndexPath, "dedup.json")
+	if err != nil {
+		return nil, err
+	}
+
+	return newDedupFileStore(fileStore, dedupStorage)
+}
+
+func newS3Client(cfg *config) *s3.Client {
+	return &s3.Client{
+		Endpoint:        cfg.s3Endpoint,
+		Region:          cfg.s3Region,
+		Bucket:          cfg.s3Bucket,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+}
+
+// newStateStorage returns where the state with the given name is kept: in the file at path, or with -store=s3,
+// in the bucket, so that every instance of the server using the bucket shares it. State that isn't in the bucket
+// yet is copied there from the file, if there is one, to carry on from a server that kept it on disk.
+func newStateStorage(cfg *config, path string, name string) (stateStorage, error) {
+	fileStorage := &fileStateStorage{path: path}
+	if cfg.storeType != "s3" {
+		return fileStorage, nil
+	}
+
+	bucketStorage := &bucketStateStorage{
+		client: newS3Client(cfg),
+		key:    cfg.s3Prefix + stateDir + "/" + name,
+	}
+
+	_, version, err := bucketStorage.Load("")
+	if err != nil || version != "" {
+		return bucketStorage, err
+	}
+
+	b, _, err := fileStorage.Load("")
+	if err != nil || b == nil {
+		return bucketStorage, err
+	}
+
+	_, err = bucketStorage.Save(b, "")
+	if err == errStateChanged {
+		// another instance of the server copied its state first
+		err = nil
+	}
+	return bucketStorage, err
+}
+
+func getWebHandler(activeFileManager *activeFileManager, fileStore fileStore, shares *shareStore, userKeys *userKeys, maxFileSize int64, limits *rateLimits, publicURL string) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		method := req.Method
 		path := urlPathToArray(req.URL.Path)
 
+		if !limits.allow(res, req, path, userKeys) {
+			return
+		}
+
 		switch {
+		case len(path) == 1 && (method == "GET" || method == "HEAD") && isBundle(shares, path[0]):
+			handleBundleIndex(res, req, path[0], shares)
+		case len(path) == 1 && (method == "GET" || method == "HEAD") && strings.HasSuffix(path[0], ".zip") && isBundle(shares, strings.TrimSuffix(path[0], ".zip")):
+			handleBundleZip(res, req, strings.TrimSuffix(path[0], ".zip"), activeFileManager, fileStore, shares)
 		case len(path) == 1:
-			if method == "GET" {
-				// request for a file
-				fileName := path[0]
-				fileReader := getReaderForFileName(fileName, activeFileManager, fileStore)
-				if fileReader == nil {
-					http.NotFound(res, req)
+			handleFile(res, req, path[0], activeFileManager, fileStore, shares, userKeys, maxFileSize, publicURL)
+		case len(path) == 2 && path[0] != "api":
+			handleBundleFile(res, req, path[0], path[1], activeFileManager, fileStore, shares, userKeys, maxFileSize, publicURL)
+		case len(path) == 2 && path[0] == "api" && (path[1] == "getfilename" || path[1] == "getbundle") && method == "GET":
+			userKey, err := userKeys.authenticate(req)
+			if err != nil {
+				unauthorized(res, err)
+				return
+			}
+
+			query := req.URL.Query()
+			fileExtension := query.Get("ext")
+
+			var ttl time.Duration
+			if ttlString := query.Get("ttl"); ttlString != "" {
+				ttl, err = time.ParseDuration(ttlString)
+				if err != nil || ttl <= 0 {
+					http.Error(res, "Bad Request: ttl must be a positive duration like 24h", http.StatusBadRequest)
 					return
 				}
-				defer fileReader.Close()
-				// stream the fileReader to the response
-				res.Header().Set("Content-Type", fileReader.ContentType())
-				http.ServeContent(res, req, "", fileReader.ModTime(), fileReader)
-			} else if method == "PUT" {
-				// uploading a file
-				handlePutFile(res, req, path[0], activeFileManager)
-			} else {
-				http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
 			}
-		case len(path) == 2 && path[0] == "api" && path[1] == "getfilename" && method == "GET":
-			fileExtension := req.URL.Query().Get("ext")
 
-			newFilename, err := activeFileManager.PrepareUpload(fileExtension, "USERKEYTODO")
+			var maxDownloads int
+			if maxDownloadsString := query.Get("maxdownloads"); maxDownloadsString != "" {
+				maxDownloads, err = strconv.Atoi(maxDownloadsString)
+				if err != nil || maxDownloads <= 0 {
+					http.Error(res, "Bad Request: maxdownloads must be a positive integer", http.StatusBadRequest)
+					return
+				}
+			}
+
+			originalName := query.Get("name")
+			if originalName != "" {
+				originalName = filepath.Base(originalName)
+			}
+
+			deleteToken, err := generateToken()
 			if err != nil {
 				http.Error(res, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
-			log.Println("/api/getfilename returning", newFilename)
+			record := shareRecord{
+				Uploader:        userKeys.userName(userKey),
+				DeleteTokenHash: hashDeleteToken(deleteToken),
+				OriginalName:    originalName,
+				MaxDownloads:    maxDownloads,
+			}
+			if ttl != 0 {
+				record.Expires = time.Now().Add(ttl)
+			}
+
+			var newFilename string
+			if path[1] == "getbundle" {
+				record.OriginalName = ""
+				newFilename, err = activeFileManager.PrepareBundle(record)
+			} else {
+				newFilename, err = activeFileManager.PrepareUpload(fileExtension, userKey, record)
+			}
+			if err == errTooManyPrepared {
+				// prepared uploads that aren't started time out
+				res.Header().Set("Retry-After", retryAfterSeconds(activeFileManager.uploadIdleTimeout))
+			}
+			if err != nil {
+				uploadError(res, err)
+				return
+			}
+
+			log.Println("/api/"+path[1], "returning", newFilename, "to", record.Uploader)
+
+			res.Header().Set("X-Delete-Token", deleteToken)
 
 			res.Write([]byte(newFilename))
+		case len(path) == 2 && path[0] == "api" && path[1] == "quota" && method == "GET":
+			userKey, err := userKeys.authenticate(req)
+			if err != nil {
+				unauthorized(res, err)
+				return
+			}
+
+			res.Header().Set("Content-Type", "application/json")
+			res.Header().Set("Cache-Control", "no-store")
+			json.NewEncoder(res).Encode(activeFileManager.Quota(userKeys.userName(userKey)))
+		case len(path) == 3 && path[0] == "api" && path[1] == "files" && method == "DELETE":
+			handleDeleteFile(res, req, path[2], activeFileManager, shares, userKeys)
 		default:
 			http.NotFound(res, req)
 		}
 	})
 }
 
-func handlePutFile(res http.ResponseWriter, req *http.Request, fileName string, activeFileManager *activeFileManager) {
-	contentType := req.Header.Get("Content-Type")
+// handleFile handles requests for a single file: downloads, uploads and deletes.
+// publicURL is the base URL the server is reached at, or empty to take it from each request.
+func handleFile(res http.ResponseWriter, req *http.Request, fileName string, activeFileManager *activeFileManager, fileStore fileStore, shares *shareStore, userKeys *userKeys, maxFileSize int64, publicURL string) {
+	if req.Method == "HEAD" && req.Header.Get("Authorization") != "" && activeFileManager.IsActive(fileName) {
+		// uploader asking how much of the file was received, in order to resume
+		handleUploadStatus(res, req, fileName, activeFileManager, userKeys)
+	} else if req.Method == "GET" || req.Method == "HEAD" {
+		// request for a file
+		fileReader := getReaderForFileName(fileName, activeFileManager, fileStore, shares)
+		if fileReader == nil {
+			if shares.IsExpired(fileName, time.Now()) {
+				http.Error(res, "Gone", http.StatusGone)
+				return
+			}
+			http.NotFound(res, req)
+			return
+		}
+		defer fileReader.Close()
+		variant, err := parseImageVariant(req, fileName)
+		if err != nil {
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if variant != nil && activeFileManager.IsActive(fileName) {
+			// variants are made from the whole image
+			http.Error(res, "Conflict: the image is still uploading; resized versions are available once it's done", http.StatusConflict)
+			return
+		}
+		if variant == nil && !isPasteFile(fileName) {
+			// browsers and link preview bots get a page showing the file
+			res.Header().Set("Vary", "Accept, User-Agent")
+			if wantsLandingPage(req, fileReader.ContentType()) {
+				if shares.IsExpired(fileName, time.Now()) {
+					http.Error(res, "Gone", http.StatusGone)
+					return
+				}
+				serveLandingPage(res, req, fileName, fileReader, publicURL)
+				return
+			}
+		}
+		if isDownloadStart(req) && !isUploaderRequest(req, fileName, shares, userKeys) {
+			err := shares.CountDownload(fileName, time.Now())
+			if err == errShareExpired {
+				http.Error(res, "Gone", http.StatusGone)
+				return
+			} else if err != nil {
+				log.Println("Failed to count download:", err)
+			}
+		} else if shares.IsExpired(fileName, time.Now()) {
+			http.Error(res, "Gone", http.StatusGone)
+			return
+		}
+		if variant != nil {
+			serveImageVariant(res, req, fileName, variant, fileReader, fileStore, shares)
+			return
+		}
+		if isPasteFile(fileName) {
+			// text files are shown in the paste view in browsers
+			res.Header().Set("Vary", "Accept")
+			if wantsPasteView(req) && servePaste(res, req, fileName, displayFileName(fileName, fileReader), fileReader) {
+				return
+			}
+		}
+		// stream the fileReader to the response
+		res.Header().Set("Content-Type", fileReader.ContentType())
+		if shareFileReader, ok := fileReader.(*shareFileReader); ok {
+			setShareHeaders(res, shareFileReader.Record())
+		}
+		if size, err := fileReader.Size(); err == nil && size == -1 {
+			// the file is still being uploaded with chunked encoding, so it can only be streamed as it arrives
+			streamFile(res, req, fileReader)
+			return
+		}
+		http.ServeContent(res, req, "", fileReader.ModTime(), fileReader)
+	} else if req.Method == "PUT" {
+		// uploading a file
+		handlePutFile(res, req, fileName, activeFileManager, userKeys, maxFileSize)
+	} else if req.Method == "PATCH" {
+		// resuming an interrupted upload
+		handlePatchFile(res, req, fileName, activeFileManager, userKeys)
+	} else if req.Method == "DELETE" {
+		handleDeleteFile(res, req, fileName, activeFileManager, shares, userKeys)
+	} else {
+		http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-	if contentType == "" {
-		http.Error(res, "Bad Request: Missing required Content-Type header", http.StatusBadRequest)
+func handlePutFile(res http.ResponseWriter, req *http.Request, fileName string, activeFileManager *activeFileManager, userKeys *userKeys, maxFileSize int64) {
+	userKey, err := userKeys.authenticate(req)
+	if err != nil {
+		unauthorized(res, err)
 		return
 	}
 
-	if req.ContentLength < 1 {
-		http.Error(res, "Bad Request: Content-Length is required and must be positive", http.StatusBadRequest)
+	if !checkPutFile(res, req, maxFileSize) {
 		return
 	}
 
+	err = activeFileManager.Upload(fileName, req.Header.Get("Content-Type"), req.Body, int(req.ContentLength), userKey)
+	if err != nil {
+		uploadError(res, err)
+	}
+}
+
+// checkPutFile returns true if the upload request's headers are acceptable. Otherwise, it responds with 400 Bad Request.
+func checkPutFile(res http.ResponseWriter, req *http.Request, maxFileSize int64) bool {
+	if req.Header.Get("Content-Type") == "" {
+		http.Error(res, "Bad Request: Missing required Content-Type header", http.StatusBadRequest)
+		return false
+	}
+
+	// a ContentLength of -1 means the body is sent with chunked encoding, and its length is only known once it ends
+	if req.ContentLength == 0 {
+		http.Error(res, "Bad Request: Content-Length must be positive, or the body must use chunked transfer encoding", http.StatusBadRequest)
+		return false
+	}
+
 	if req.ContentLength >= maxFileSize {
-		http.Error(res, "Bad Request: File to upload exceeds "+strconv.Itoa(maxFileSize), http.StatusBadRequest)
+		http.Error(res, "Bad Request: File to upload exceeds "+strconv.FormatInt(maxFileSize, 10), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// handleUploadStatus reports how much of an upload has been received, so that the uploader can resume it with PATCH.
+func handleUploadStatus(res http.ResponseWriter, req *http.Request, fileName string, activeFileManager *activeFileManager, userKeys *userKeys) {
+	userKey, err := userKeys.authenticate(req)
+	if err != nil {
+		unauthorized(res, err)
 		return
 	}
 
-	err := activeFileManager.Upload(fileName, req.Body, int(req.ContentLength), "USERKEYTODO")
+	offset, length, err := activeFileManager.UploadOffset(fileName, userKey)
+	if err != nil {
+		uploadError(res, err)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Upload-Offset", strconv.Itoa(offset))
+	if length != -1 {
+		res.Header().Set("Upload-Length", strconv.Itoa(length))
+	} else {
+		res.Header().Set("Upload-Defer-Length", "1")
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// handlePatchFile resumes an interrupted upload. The request's Upload-Offset header must match the number of bytes received so far,
+// and its body holds the rest of the file (or a part of it) from there on.
+func handlePatchFile(res http.ResponseWriter, req *http.Request, fileName string, activeFileManager *activeFileManager, userKeys *userKeys) {
+	userKey, err := userKeys.authenticate(req)
 	if err != nil {
+		unauthorized(res, err)
+		return
+	}
+
+	offset, err := strconv.Atoi(req.Header.Get("Upload-Offset"))
+	if err != nil || offset < 0 {
+		http.Error(res, "Bad Request: Upload-Offset header is required and must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	newOffset, err := activeFileManager.Resume(fileName, req.Body, offset, userKey)
+	if err != nil {
+		uploadError(res, err)
+		return
+	}
+
+	res.Header().Set("Upload-Offset", strconv.Itoa(newOffset))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// uploadError responds with the status code that best describes an error from activeFileManager's upload methods.
+func uploadError(res http.ResponseWriter, err error) {
+	switch err {
+	case errNoPreparedUpload, errNoSuchBundle:
+		http.Error(res, "Not Found: "+err.Error(), http.StatusNotFound)
+	case errUserKeyMismatch:
+		http.Error(res, "Forbidden: "+err.Error(), http.StatusForbidden)
+	case errFileDeleted, errShareExpired:
+		http.Error(res, "Gone: "+err.Error(), http.StatusGone)
+	case errAlreadyUploading, errUploadNotStarted, errOffsetMismatch, errBundleHasFile:
+		http.Error(res, "Conflict: "+err.Error(), http.StatusConflict)
+	case errUploadTooLong:
+		http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+	case errFileTooLarge:
+		http.Error(res, "Request Entity Too Large: "+err.Error(), http.StatusRequestEntityTooLarge)
+	case errTooManyPrepared:
+		http.Error(res, "Too Many Requests: "+err.Error(), http.StatusTooManyRequests)
+	case errQuotaExceeded, errStorageFull:
+		http.Error(res, "Insufficient Storage: "+err.Error(), http.StatusInsufficientStorage)
+	default:
 		http.Error(res, "Error: "+err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func getReaderForFileName(fileName string, activeFileManager *activeFileManager, fileStore fileStore) fileReader {
-	fileReader := activeFileManager.GetReaderForFileName(fileName)
+// handleDeleteFile takes down a share. The request must carry either the uploader's API key,
+// or the share's delete token in the X-Delete-Token header or the "token" query parameter.
+func handleDeleteFile(res http.ResponseWriter, req *http.Request, fileName string, activeFileManager *activeFileManager, shares *shareStore, userKeys *userKeys) {
+	record, exists := shares.Get(fileName)
+	if !exists {
+		http.NotFound(res, req)
+		return
+	}
+	if record.Expired {
+		http.Error(res, "Gone", http.StatusGone)
+		return
+	}
 
-	if fileReader != nil {
-		return fileReader
+	deleteToken := req.Header.Get("X-Delete-Token")
+	if deleteToken == "" {
+		deleteToken = req.URL.Query().Get("token")
+	}
+
+	if !record.isDeleteToken(deleteToken) {
+		userKey, err := userKeys.authenticate(req)
+		if err != nil {
+			unauthorized(res, err)
+			return
+		}
+		if userKeys.userName(userKey) != record.Uploader {
+			http.Error(res, "Forbidden: file was uploaded by a different user", http.StatusForbidden)
+			return
+		}
 	}
 
-	fileReader, err := fileStore.GetFileReader(fileName)
+	err := activeFileManager.Delete(fileName)
 	if err != nil {
-		return nil
+		http.Error(res, "Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Deleted", fileName)
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// unauthorized responds with 401 Unauthorized, asking the client for a bearer token.
+func unauthorized(res http.ResponseWriter, err error) {
+	res.Header().Set("WWW-Authenticate", `Bearer realm="Instant Share"`)
+	http.Error(res, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+}
+
+// isDownloadStart returns true if req fetches the file from its beginning, as opposed to resuming or seeking within it.
+// Only such requests count towards a share's maximum number of downloads, since players fetch videos with many range requests.
+func isDownloadStart(req *http.Request) bool {
+	if req.Method != "GET" {
+		return false
+	}
+
+	rangeHeader := req.Header.Get("Range")
+
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+// isUploaderRequest returns true if req carries the API key of the user who shared the file.
+// Uploaders looking at their own shares, like the desktop client showing thumbnails of recent shares, don't use up its downloads.
+func isUploaderRequest(req *http.Request, fileName string, shares *shareStore, userKeys *userKeys) bool {
+	if req.Header.Get("Authorization") == "" {
+		return false
+	}
+	userKey, err := userKeys.authenticate(req)
+	if err != nil {
+		return false
+	}
+	record, exists := shares.Get(fileName)
+	return exists && record.Uploader == userKeys.userName(userKey)
+}
+
+// streamFile sends fileReader to the client as its data becomes available, flushing after every read.
+// It's used for files whose length isn't known yet, so the response uses chunked encoding and ignores Range headers.
+func streamFile(res http.ResponseWriter, req *http.Request, fileReader fileReader) {
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+
+	if req.Method == "HEAD" {
+		return
+	}
+
+	flusher, _ := res.(http.Flusher)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := fileReader.Read(buf)
+		if n > 0 {
+			if _, writeErr := res.Write(buf[:n]); writeErr != nil {
+				// the client went away
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			// the upload was aborted or deleted; ending the response early lets the client know it's incomplete
+			log.Println("Failed to stream file:", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// displayFileName returns the name to show for the file: the name it was shared with, if it's known.
+func displayFileName(fileName string, fileReader fileReader) string {
+	if shareFileReader, ok := fileReader.(*shareFileReader); ok && shareFileReader.Record().OriginalName != "" {
+		return shareFileReader.Record().OriginalName
+	}
+	return path.Base(fileName)
+}
+
+// setShareHeaders sets response headers that describe the share being served.
+func setShareHeaders(res http.ResponseWriter, record shareRecord) {
+	if record.OriginalName != "" {
+		res.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": record.OriginalName}))
+	}
+	if record.SHA256 != "" {
+		res.Header().Set("ETag", `"`+record.SHA256+`"`)
+	}
+}
+
+func getReaderForFileName(fileName string, activeFileManager *activeFileManager, fileStore fileStore, shares *shareStore) fileReader {
+	fileReader := activeFileManager.GetReaderForFileName(fileName)
+
+	if fileReader == nil {
+		var err error
+		fileReader, err = fileStore.GetFileReader(fileName)
+		if err != nil {
+			return nil
+		}
+	}
+
+	// the record is fetched after the reader, so that it reflects the upload having started
+	if record, exists := shares.Get(fileName); exists {
+		return &shareFileReader{
+			fileReader: fileReader,
+			fileName:   fileName,
+			record:     record,
+		}
 	}
 
 	return fileReader
@@ -0,0 +1,1034 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pavben/InstantShare/server/ratelimit"
+)
+
+const (
+	testAliceKey = "alicekey"
+	testBobKey   = "bobkey"
+)
+
+type testServer struct {
+	*httptest.Server
+	fileStore         fileStore
+	shares            *shareStore
+	activeFileManager *activeFileManager
+	limits            *rateLimits
+}
+
+func newTestServer(t *testing.T) *testServer {
+	fileStore := newMemoryFileStore(0)
+
+	shares, err := newShareStore(&fileStateStorage{path: filepath.Join(t.TempDir(), "shares.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userKeys := &userKeys{
+		users: map[string]string{
+			testAliceKey: "alice",
+			testBobKey:   "bob",
+		},
+	}
+
+	activeFileManager := newActiveFileManager(fileStore, shares, 200*1024*1024, 10*time.Second, time.Hour, 250000, 0, quotas{})
+	limits := &rateLimits{}
+
+	server := httptest.NewServer(getWebHandler(activeFileManager, fileStore, shares, userKeys, 200*1024*1024, limits, ""))
+	t.Cleanup(server.Close)
+
+	return &testServer{
+		Server:            server,
+		fileStore:         fileStore,
+		shares:            shares,
+		activeFileManager: activeFileManager,
+		limits:            limits,
+	}
+}
+
+func (ts *testServer) do(t *testing.T, method string, path string, userKey string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userKey != "" {
+		req.Header.Set("Authorization", "Bearer "+userKey)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// prepare calls /api/getfilename and returns the new filename and its delete token.
+func (ts *testServer) prepare(t *testing.T, query string, userKey string) (string, string) {
+	resp := ts.do(t, "GET", "/api/getfilename?"+query, userKey, nil)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("prepare: got %v %q", resp.Status, body)
+	}
+
+	return string(body), resp.Header.Get("X-Delete-Token")
+}
+
+func (ts *testServer) upload(t *testing.T, fileName string, userKey string, data []byte) {
+	resp := ts.do(t, "PUT", "/"+fileName, userKey, bytes.NewReader(data))
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: got %v", resp.Status)
+	}
+}
+
+// download returns the status code and body of a GET for fileName.
+func (ts *testServer) download(t *testing.T, fileName string) (int, []byte) {
+	resp := ts.do(t, "GET", "/"+fileName, "", nil)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, body
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, _ := ts.prepare(t, "ext=txt&name=notes.txt", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, []byte("hello world"))
+
+	resp := ts.do(t, "GET", "/"+fileName, "", nil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(body) != "hello world" {
+		t.Errorf("got %v %q, want 200 OK %q", resp.Status, body, "hello world")
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Disposition"), "inline; filename=notes.txt"; got != want {
+		t.Errorf("got Content-Disposition %q, want %q", got, want)
+	}
+
+	if statusCode, _ := ts.download(t, "nosuchfile.txt"); statusCode != http.StatusNotFound {
+		t.Errorf("got %d for a file that doesn't exist, want 404", statusCode)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, userKey := range []string{"", "wrongkey"} {
+		resp := ts.do(t, "GET", "/api/getfilename?ext=txt", userKey, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("prepare with key %q: got %v, want 401", userKey, resp.Status)
+		}
+	}
+
+	fileName, _ := ts.prepare(t, "ext=txt", testAliceKey)
+
+	resp := ts.do(t, "PUT", "/"+fileName, "", bytes.NewReader([]byte("hijacked")))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("upload without key: got %v, want 401", resp.Status)
+	}
+
+	resp = ts.do(t, "PUT", "/"+fileName, testBobKey, bytes.NewReader([]byte("hijacked")))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload with another user's key: got %v, want 403", resp.Status)
+	}
+
+	// the rightful uploader must still be able to upload
+	ts.upload(t, fileName, testAliceKey, []byte("hello"))
+}
+
+// Downloads that start before the upload finishes should receive the whole file as it arrives.
+func TestDownloadDuringUpload(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, _ := ts.prepare(t, "ext=bin", testAliceKey)
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	bodyReader, bodyWriter := io.Pipe()
+
+	uploadDone := make(chan int)
+	go func() {
+		req, err := http.NewRequest("PUT", ts.URL+"/"+fileName, bodyReader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.ContentLength = int64(len(data))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Authorization", "Bearer "+testAliceKey)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Error(err)
+			close(uploadDone)
+			return
+		}
+		resp.Body.Close()
+		uploadDone <- resp.StatusCode
+	}()
+
+	// send the first half, then start downloading
+	_, err := bodyWriter.Write(data[:len(data)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloadDone := make(chan []byte)
+	go func() {
+		_, body := ts.download(t, fileName)
+		downloadDone <- body
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = bodyWriter.Write(data[len(data)/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyWriter.Close()
+
+	if statusCode := <-uploadDone; statusCode != http.StatusOK {
+		t.Errorf("upload: got %d, want 200", statusCode)
+	}
+	if body := <-downloadDone; !bytes.Equal(body, data) {
+		t.Errorf("download: got %d bytes, want %d bytes", len(body), len(data))
+	}
+}
+
+func TestMaxDownloads(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, _ := ts.prepare(t, "ext=txt&maxdownloads=2", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, []byte("hello"))
+
+	// the uploader's own downloads aren't counted
+	for i := 0; i < 3; i++ {
+		resp := ts.do(t, "GET", "/"+fileName, testAliceKey, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("download %d by the uploader: got %v, want 200", i+1, resp.Status)
+		}
+	}
+
+	// but other users' are
+	resp := ts.do(t, "GET", "/"+fileName, testBobKey, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download by another user: got %v, want 200", resp.Status)
+	}
+	if statusCode, _ := ts.download(t, fileName); statusCode != http.StatusOK {
+		t.Fatalf("second download: got %d, want 200", statusCode)
+	}
+
+	if statusCode, _ := ts.download(t, fileName); statusCode != http.StatusGone {
+		t.Errorf("download past the limit: got %d, want 410", statusCode)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, deleteToken := ts.prepare(t, "ext=txt", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, []byte("oops"))
+
+	resp := ts.do(t, "DELETE", "/"+fileName, testBobKey, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete by another user: got %v, want 403", resp.Status)
+	}
+
+	resp = ts.do(t, "DELETE", "/api/files/"+fileName+"?token="+deleteToken, "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete with token: got %v, want 204", resp.Status)
+	}
+
+	if statusCode, _ := ts.download(t, fileName); statusCode != http.StatusGone {
+		t.Errorf("download after delete: got %d, want 410", statusCode)
+	}
+	if _, err := ts.fileStore.GetFileReader(fileName); err == nil {
+		t.Error("file is still in the store after delete")
+	}
+}
+
+// Deleting a file that's still uploading should stop the upload.
+func TestDeleteDuringUpload(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, _ := ts.prepare(t, "ext=bin", testAliceKey)
+
+	bodyReader, bodyWriter := io.Pipe()
+	uploadDone := make(chan int)
+	go func() {
+		req, err := http.NewRequest("PUT", ts.URL+"/"+fileName, bodyReader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.ContentLength = 1000
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Authorization", "Bearer "+testAliceKey)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			// the server may close the connection before the client is done sending
+			close(uploadDone)
+			return
+		}
+		resp.Body.Close()
+		uploadDone <- resp.StatusCode
+	}()
+
+	_, err := bodyWriter.Write(make([]byte, 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := ts.do(t, "DELETE", "/"+fileName, testAliceKey, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete: got %v, want 204", resp.Status)
+	}
+
+	// the upload notices the deletion once more data arrives
+	bodyWriter.Write(make([]byte, 500))
+	bodyWriter.Close()
+
+	if statusCode, ok := <-uploadDone; ok && statusCode != http.StatusGone {
+		t.Errorf("upload: got %d, want 410", statusCode)
+	}
+	if statusCode, _ := ts.download(t, fileName); statusCode != http.StatusGone {
+		t.Errorf("download after delete: got %d, want 410", statusCode)
+	}
+}
+
+// errorAfterReader returns data, then fails as if the connection was lost.
+type errorAfterReader struct {
+	data []byte
+}
+
+func (r *errorAfterReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection lost")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestResumeUpload(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, _ := ts.prepare(t, "ext=bin", testAliceKey)
+
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	// the first attempt is interrupted after 400 bytes
+	req, err := http.NewRequest("PUT", ts.URL+"/"+fileName, &errorAfterReader{data: data[:400]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Authorization", "Bearer "+testAliceKey)
+	if resp, err := ts.Client().Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("interrupted upload: got %v, want an error", resp.Status)
+	}
+
+	// a download that starts now should wait for the rest rather than fail
+	downloadDone := make(chan []byte)
+	go func() {
+		_, body := ts.download(t, fileName)
+		downloadDone <- body
+	}()
+
+	// wait for the server to notice the interruption
+	var offset string
+	for i := 0; i < 100; i++ {
+		resp := ts.do(t, "HEAD", "/"+fileName, testAliceKey, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("HEAD: got %v, want 200", resp.Status)
+		}
+		offset = resp.Header.Get("Upload-Offset")
+		if offset == "400" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if offset != "400" {
+		t.Fatalf("got Upload-Offset %q, want 400", offset)
+	}
+
+	for i := 0; ; i++ {
+		req, err := http.NewRequest("PATCH", ts.URL+"/"+fileName, bytes.NewReader(data[400:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Upload-Offset", "400")
+		req.Header.Set("Authorization", "Bearer "+testAliceKey)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// the server may not be done with the interrupted request yet
+		if resp.StatusCode == http.StatusConflict && i < 100 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "1000" {
+			t.Fatalf("PATCH: got %v with Upload-Offset %q, want 204 with 1000", resp.Status, resp.Header.Get("Upload-Offset"))
+		}
+		break
+	}
+
+	if body := <-downloadDone; !bytes.Equal(body, data) {
+		t.Errorf("download: got %d bytes, want %d bytes", len(body), len(data))
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, _ := ts.prepare(t, "ext=log", testAliceKey)
+
+	// a body without a known length is sent with chunked encoding
+	bodyReader, bodyWriter := io.Pipe()
+	req, err := http.NewRequest("PUT", ts.URL+"/"+fileName, bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", "Bearer "+testAliceKey)
+
+	uploadDone := make(chan error)
+	go func() {
+		resp, err := ts.Client().Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = errors.New(resp.Status)
+			}
+		}
+		uploadDone <- err
+	}()
+
+	bodyWriter.Write([]byte("first line\n"))
+
+	// the download should get what has been uploaded so far, without waiting for the upload to end
+	resp := ts.do(t, "GET", "/"+fileName, "", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != -1 {
+		t.Fatalf("download: got %v with Content-Length %d, want 200 OK with unknown length", resp.Status, resp.ContentLength)
+	}
+
+	firstLine := make([]byte, len("first line\n"))
+	if _, err := io.ReadFull(resp.Body, firstLine); err != nil || string(firstLine) != "first line\n" {
+		t.Fatalf("download: got %q, %v, want %q", firstLine, err, "first line\n")
+	}
+
+	bodyWriter.Write([]byte("second line\n"))
+	bodyWriter.Close()
+
+	if err := <-uploadDone; err != nil {
+		t.Fatal("upload:", err)
+	}
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "second line\n" {
+		t.Errorf("download: got rest %q, %v, want %q", rest, err, "second line\n")
+	}
+
+	if record, _ := ts.shares.Get(fileName); record.Size != len("first line\nsecond line\n") {
+		t.Errorf("got record size %d, want %d", record.Size, len("first line\nsecond line\n"))
+	}
+	if statusCode, body := ts.download(t, fileName); statusCode != http.StatusOK || string(body) != "first line\nsecond line\n" {
+		t.Errorf("download after upload: got %d %q", statusCode, body)
+	}
+}
+
+func TestChunkedUploadGoesQuiet(t *testing.T) {
+	ts := newTestServer(t)
+	ts.activeFileManager.uploadIdleTimeout = 100 * time.Millisecond
+
+	fileName, _ := ts.prepare(t, "ext=log", testAliceKey)
+
+	bodyReader, bodyWriter := io.Pipe()
+	req, err := http.NewRequest("PUT", ts.URL+"/"+fileName, bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", "Bearer "+testAliceKey)
+
+	uploadDone := make(chan error)
+	go func() {
+		resp, err := ts.Client().Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = errors.New(resp.Status)
+			}
+		}
+		uploadDone <- err
+	}()
+
+	// the source goes quiet for longer than the upload idle timeout, while the request stays connected
+	bodyWriter.Write([]byte("building\n"))
+	time.Sleep(500 * time.Millisecond)
+	bodyWriter.Write([]byte("done\n"))
+	bodyWriter.Close()
+
+	if err := <-uploadDone; err != nil {
+		t.Fatal("upload:", err)
+	}
+	if statusCode, body := ts.download(t, fileName); statusCode != http.StatusOK || string(body) != "building\ndone\n" {
+		t.Errorf("download: got %d %q, want the whole log", statusCode, body)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp := ts.do(t, "GET", "/api/getbundle?maxdownloads=1", testAliceKey, nil)
+	bundleName, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("getbundle: got %v %q, %v", resp.Status, bundleName, err)
+	}
+
+	files := map[string]string{
+		"one.txt": "first file",
+		"two.txt": "second file",
+	}
+	ts.upload(t, string(bundleName)+"/one.txt", testAliceKey, []byte(files["one.txt"]))
+
+	// a rejected upload doesn't keep the name from being uploaded to
+	req, err := http.NewRequest("PUT", ts.URL+"/"+string(bundleName)+"/two.txt", strings.NewReader(files["two.txt"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAliceKey)
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload without a Content-Type: got %v, want 400", resp.Status)
+	}
+	ts.upload(t, string(bundleName)+"/two.txt", testAliceKey, []byte(files["two.txt"]))
+
+	// a file can't be uploaded again, and trying leaves the one uploaded alone
+	resp = ts.do(t, "PUT", "/"+string(bundleName)+"/one.txt", testAliceKey, strings.NewReader("replaced"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("uploading a file again: got %v, want 409", resp.Status)
+	}
+	if statusCode, body := ts.download(t, string(bundleName)+"/one.txt"); statusCode != http.StatusOK || string(body) != files["one.txt"] {
+		t.Errorf("file after uploading it again: got %d %q", statusCode, body)
+	}
+
+	resp = ts.do(t, "PUT", "/"+string(bundleName)+"/three.txt", testBobKey, bytes.NewReader([]byte("not alice")))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload by another user: got %v, want 403", resp.Status)
+	}
+
+	statusCode, index := ts.download(t, string(bundleName)+"/")
+	if statusCode != http.StatusOK || !bytes.Contains(index, []byte(`href="one.txt"`)) || !bytes.Contains(index, []byte(`href="two.txt"`)) {
+		t.Errorf("index: got %d %q", statusCode, index)
+	}
+
+	if statusCode, body := ts.download(t, string(bundleName)+"/two.txt"); statusCode != http.StatusOK || string(body) != files["two.txt"] {
+		t.Errorf("file: got %d %q", statusCode, body)
+	}
+
+	statusCode, zipData := ts.download(t, string(bundleName)+".zip")
+	if statusCode != http.StatusOK {
+		t.Fatalf("zip: got %d", statusCode)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zipReader.File) != len(files) {
+		t.Errorf("zip: got %d files, want %d", len(zipReader.File), len(files))
+	}
+	for _, zipFile := range zipReader.File {
+		r, err := zipFile.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(contents) != files[zipFile.Name] {
+			t.Errorf("zip: got %q for %s, want %q", contents, zipFile.Name, files[zipFile.Name])
+		}
+	}
+
+	// the zip download used up the bundle's only download
+	if statusCode, _ := ts.download(t, string(bundleName)+"/one.txt"); statusCode != http.StatusGone {
+		t.Errorf("file after the bundle expired: got %d, want 410", statusCode)
+	}
+}
+
+func TestPasteView(t *testing.T) {
+	ts := newTestServer(t)
+
+	const paste = "package main\n\n// main prints <hello>.\nfunc main() {\n\tprintln(\"hello\")\n}\n"
+	fileName, _ := ts.prepare(t, "ext=go", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, []byte(paste))
+
+	get := func(path string, accept string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	// browsers get the paste view
+	resp, body := get("/"+fileName, "text/html,application/xhtml+xml,*/*;q=0.8")
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("paste view: got Content-Type %q", got)
+	}
+	for _, want := range []string{
+		`<tr id="L6">`,
+		`<span class="k">func</span> main()`,
+		`<span class="c">// main prints &lt;hello&gt;.</span>`,
+		`<span class="s">&#34;hello&#34;</span>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("paste view doesn't contain %q:\n%s", want, body)
+		}
+	}
+	if resp.Header.Get("Vary") != "Accept" {
+		t.Errorf("paste view: got Vary %q, want Accept", resp.Header.Get("Vary"))
+	}
+
+	// everything else gets the text, as do browsers asking for it
+	for _, tc := range []struct{ path, accept string }{
+		{"/" + fileName, "*/*"},
+		{"/" + fileName + "?raw=1", "text/html"},
+	} {
+		resp, body := get(tc.path, tc.accept)
+		if got := resp.Header.Get("Content-Type"); strings.HasPrefix(got, "text/html") || body != paste {
+			t.Errorf("%s with Accept %q: got %q %q, want the text", tc.path, tc.accept, got, body)
+		}
+	}
+}
+
+func TestImageVariants(t *testing.T) {
+	ts := newTestServer(t)
+
+	var original bytes.Buffer
+	err := png.Encode(&original, image.NewNRGBA(image.Rect(0, 0, 200, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileName, deleteToken := ts.prepare(t, "ext=png", testAliceKey)
+
+	bodyReader, bodyWriter := io.Pipe()
+	uploadDone := make(chan int)
+	go func() {
+		req, err := http.NewRequest("PUT", ts.URL+"/"+fileName, bodyReader)
+		if err != nil {
+			t.Error(err)
+			close(uploadDone)
+			return
+		}
+		req.ContentLength = int64(original.Len())
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Authorization", "Bearer "+testAliceKey)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Error(err)
+			close(uploadDone)
+			return
+		}
+		resp.Body.Close()
+		uploadDone <- resp.StatusCode
+	}()
+
+	_, err = bodyWriter.Write(original.Bytes()[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// variants are made once the whole image is there
+	if statusCode, _ := ts.download(t, fileName+"?w=50"); statusCode != http.StatusConflict {
+		t.Errorf("variant during upload: got %d, want 409", statusCode)
+	}
+
+	_, err = bodyWriter.Write(original.Bytes()[10:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyWriter.Close()
+	if statusCode := <-uploadDone; statusCode != http.StatusOK {
+		t.Fatalf("upload: got %d, want 200", statusCode)
+	}
+
+	// requests for a variant that's being made wait for it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statusCode, body := ts.download(t, fileName+"?w=50&format=jpeg")
+			if statusCode != http.StatusOK {
+				t.Errorf("variant: got %d %q", statusCode, body)
+				return
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if config.Width != 50 || config.Height != 25 {
+				t.Errorf("variant: got %dx%d, want 50x25", config.Width, config.Height)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the variant was made once and kept
+	record, _ := ts.shares.Get(fileName)
+	if len(record.Variants) != 1 {
+		t.Fatalf("got variants %q, want one", record.Variants)
+	}
+	if _, err := ts.fileStore.GetFileReader(record.Variants[0]); err != nil {
+		t.Errorf("variant isn't stored: %v", err)
+	}
+
+	for _, query := range []string{"w=0", "w=abc", "format=bmp"} {
+		if statusCode, _ := ts.download(t, fileName+"?"+query); statusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, statusCode)
+		}
+	}
+
+	// deleting the share removes its variants
+	resp := ts.do(t, "DELETE", "/"+fileName+"?token="+deleteToken, "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %v", resp.Status)
+	}
+	if _, err := ts.fileStore.GetFileReader(record.Variants[0]); err == nil {
+		t.Error("variant wasn't removed along with the share")
+	}
+
+	// files without share records get no variants, as they'd have to be made on every request
+	fileName, _ = ts.prepare(t, "ext=png", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, original.Bytes())
+	err = ts.shares.Remove(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode, _ := ts.download(t, fileName+"?w=50"); statusCode != http.StatusNotFound {
+		t.Errorf("variant of a file without a record: got %d, want 404", statusCode)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	ts := newTestServer(t)
+
+	fileName, _ := ts.prepare(t, "ext=png&name=screenshot.png", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, []byte("\x89PNG not really"))
+	limitedFileName, _ := ts.prepare(t, "ext=png&maxdownloads=2&name=limited.png", testAliceKey)
+	ts.upload(t, limitedFileName, testAliceKey, []byte("\x89PNG not really"))
+
+	get := func(fileName string, query string, header string, value string) (int, string, string) {
+		req, err := http.NewRequest("GET", ts.URL+"/"+fileName+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(header, value)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+
+	// browsers and link preview bots get the landing page, which doesn't count as a download
+	for _, tc := range []struct{ header, value string }{
+		{"Accept", "text/html,application/xhtml+xml,*/*;q=0.8"},
+		{"User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"},
+	} {
+		_, contentType, body := get(fileName, "", tc.header, tc.value)
+		if contentType != "text/html; charset=utf-8" {
+			t.Errorf("%s %q: got Content-Type %q, want the landing page", tc.header, tc.value, contentType)
+		}
+		want := `<meta property="og:image" content="` + ts.URL + "/" + fileName + `?raw=1">`
+		if !strings.Contains(body, want) || !strings.Contains(body, "screenshot.png") {
+			t.Errorf("%s %q: landing page doesn't contain %q and the name:\n%s", tc.header, tc.value, want, body)
+		}
+
+		// previews would use up shares with a download limit, so their pages don't offer any
+		_, contentType, body = get(limitedFileName, "", tc.header, tc.value)
+		if contentType != "text/html; charset=utf-8" || strings.Contains(body, "og:image") || !strings.Contains(body, "limited.png") {
+			t.Errorf("%s %q: got Content-Type %q for the limited share, want the landing page with its name and without og:image:\n%s", tc.header, tc.value, contentType, body)
+		}
+	}
+	if record, _ := ts.shares.Get(limitedFileName); record.Downloads != 0 {
+		t.Errorf("got %d downloads after the landing pages, want 0", record.Downloads)
+	}
+
+	// fetching the file counts as a download whoever asks for it
+	if _, contentType, _ := get(limitedFileName, "?raw=1", "User-Agent", "Slackbot 1.0 (+https://api.slack.com/robots)"); contentType != "image/png" {
+		t.Errorf("bot fetching the image: got Content-Type %q, want the image", contentType)
+	}
+
+	// embeds get the file
+	if _, contentType, body := get(limitedFileName, "", "Accept", "image/avif,image/webp,*/*"); contentType != "image/png" || body != "\x89PNG not really" {
+		t.Errorf("embed: got %q %q, want the image", contentType, body)
+	}
+
+	if record, _ := ts.shares.Get(limitedFileName); record.Downloads != 2 {
+		t.Errorf("got %d downloads, want 2", record.Downloads)
+	}
+	if statusCode, _, _ := get(limitedFileName, "?raw=1", "User-Agent", "Slackbot 1.0 (+https://api.slack.com/robots)"); statusCode != http.StatusGone {
+		t.Errorf("bot fetching the image after its last download: got %d, want 410", statusCode)
+	}
+
+	if _, contentType, _ := get(fileName, "?raw=1", "Accept", "text/html"); contentType != "image/png" {
+		t.Errorf("raw: got Content-Type %q, want the image", contentType)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	ts := newTestServer(t)
+	ts.activeFileManager.quotas = quotas{maxUserBytes: 10, maxUserFiles: 2}
+
+	quota := func() quotaUsage {
+		resp := ts.do(t, "GET", "/api/quota", testAliceKey, nil)
+		defer resp.Body.Close()
+		var usage quotaUsage
+		if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+			t.Fatal(err)
+		}
+		return usage
+	}
+
+	fileName, _ := ts.prepare(t, "ext=txt", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, []byte("12345678"))
+
+	if got, want := quota(), (quotaUsage{Bytes: 8, MaxBytes: 10, Files: 1, MaxFiles: 2}); got != want {
+		t.Errorf("got usage %+v, want %+v", got, want)
+	}
+
+	// the upload would take alice over her bytes quota
+	fileName, _ = ts.prepare(t, "ext=txt", testAliceKey)
+	resp := ts.do(t, "PUT", "/"+fileName, testAliceKey, strings.NewReader("123"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("upload over the bytes quota: got %v, want 507", resp.Status)
+	}
+
+	// the prepared file counts towards the files quota
+	resp = ts.do(t, "GET", "/api/getfilename?ext=txt", testAliceKey, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("prepare over the files quota: got %v, want 507", resp.Status)
+	}
+
+	// other users have quotas of their own
+	ts.prepare(t, "ext=txt", testBobKey)
+
+	// deleting a share makes room
+	ts.do(t, "DELETE", "/"+fileName, testAliceKey, nil).Body.Close()
+	fileName, _ = ts.prepare(t, "ext=txt", testAliceKey)
+	ts.upload(t, fileName, testAliceKey, []byte("12"))
+}
+
+// Uploads in progress should take up their length of the quota, so that uploads at the same time can't exceed it.
+func TestQuotaConcurrentUploads(t *testing.T) {
+	ts := newTestServer(t)
+	ts.activeFileManager.quotas = quotas{maxUserBytes: 10}
+
+	fileName, _ := ts.prepare(t, "ext=txt", testAliceKey)
+	otherFileName, _ := ts.prepare(t, "ext=txt", testAliceKey)
+
+	bodyReader, bodyWriter := io.Pipe()
+	uploadDone := make(chan int, 1)
+	go func() {
+		req, err := http.NewRequest("PUT", ts.URL+"/"+fileName, bodyReader)
+		if err != nil {
+			t.Error(err)
+			close(uploadDone)
+			return
+		}
+		req.ContentLength = 8
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Authorization", "Bearer "+testAliceKey)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Error(err)
+			close(uploadDone)
+			return
+		}
+		resp.Body.Close()
+		uploadDone <- resp.StatusCode
+	}()
+
+	// once the server reads from the body, the upload has started
+	_, err := bodyWriter.Write([]byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := ts.do(t, "PUT", "/"+otherFileName, testAliceKey, strings.NewReader("123"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("upload during another one that takes up most of the quota: got %v, want 507", resp.Status)
+	}
+
+	bodyWriter.Write([]byte("2345678"))
+	bodyWriter.Close()
+	if statusCode := <-uploadDone; statusCode != http.StatusOK {
+		t.Errorf("first upload: got %d, want 200", statusCode)
+	}
+
+	otherFileName, _ = ts.prepare(t, "ext=txt", testAliceKey)
+	ts.upload(t, otherFileName, testAliceKey, []byte("12"))
+}
+
+func TestRateLimits(t *testing.T) {
+	ts := newTestServer(t)
+	ts.limits.prepare = ratelimit.New(2)
+	ts.limits.download = ratelimit.New(3)
+
+	fileName, _ := ts.prepare(t, "ext=txt", testAliceKey)
+	ts.prepare(t, "ext=txt", testAliceKey)
+
+	resp := ts.do(t, "GET", "/api/getfilename?ext=txt", testAliceKey, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("third prepare: got %v with Retry-After %q, want 429 with 30", resp.Status, resp.Header.Get("Retry-After"))
+	}
+
+	// uploads aren't limited
+	ts.upload(t, fileName, testAliceKey, []byte("hello"))
+
+	for i := 0; i < 3; i++ {
+		if statusCode, _ := ts.download(t, fileName); statusCode != http.StatusOK {
+			t.Fatalf("download %d: got %d, want 200", i+1, statusCode)
+		}
+	}
+	if statusCode, _ := ts.download(t, fileName); statusCode != http.StatusTooManyRequests {
+		t.Errorf("fourth download: got %d, want 429", statusCode)
+	}
+}
+
+func TestMaxPrepared(t *testing.T) {
+	ts := newTestServer(t)
+	ts.activeFileManager.maxPrepared = 2
+
+	fileName, _ := ts.prepare(t, "ext=txt", testAliceKey)
+	ts.prepare(t, "ext=txt", testAliceKey)
+
+	resp := ts.do(t, "GET", "/api/getfilename?ext=txt", testAliceKey, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "10" {
+		t.Errorf("third prepare: got %v with Retry-After %q, want 429 with 10", resp.Status, resp.Header.Get("Retry-After"))
+	}
+
+	// other users can still prepare uploads
+	ts.prepare(t, "ext=txt", testBobKey)
+
+	// once an upload starts, it no longer counts
+	ts.upload(t, fileName, testAliceKey, []byte("hello"))
+	ts.prepare(t, "ext=txt", testAliceKey)
+}
+
+// Prepared uploads that are never started should leave nothing running once they time out.
+func TestExpiredPreparesLeaveNoGoroutines(t *testing.T) {
+	ts := newTestServer(t)
+	ts.activeFileManager.uploadIdleTimeout = 20 * time.Millisecond
+
+	// the first request starts the connection's goroutines, which are kept for the next ones
+	ts.prepare(t, "ext=txt", testAliceKey)
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		ts.prepare(t, "ext=txt", testAliceKey)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ts.activeFileManager.RLock()
+		activeFiles := len(ts.activeFileManager.activeFiles)
+		ts.activeFileManager.RUnlock()
+
+		goroutines := runtime.NumGoroutine()
+		if activeFiles == 0 && goroutines <= before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d active files and %d goroutines after the prepared uploads timed out, want 0 and at most %d", activeFiles, goroutines, before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errMemoryStoreFull = errors.New("memory store is full")
+)
+
+// memoryFileStore keeps files in memory. It's meant for tests and for ephemeral deployments.
+//
+// When capacity is exceeded, the least recently used files are evicted to make room.
+// Files that are still being written are never evicted.
+type memoryFileStore struct {
+	capacity int64 // Maximum total size of all files in bytes; 0 means unlimited.
+	size     int64
+	files    map[string]*list.Element // File name -> element of lru holding a *memoryFile.
+	lru      *list.List               // Most recently used files are at the front.
+
+	sync.Mutex
+}
+
+type memoryFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+	writing bool
+
+	sync.RWMutex
+}
+
+func newMemoryFileStore(capacity int64) fileStore {
+	return &memoryFileStore{
+		capacity: capacity,
+		files:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (mfs *memoryFileStore) GetFileReader(fileName string) (fileReader, error) {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	element, exists := mfs.files[fileName]
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+	}
+
+	mfs.lru.MoveToFront(element)
+
+	return &memoryFileReader{
+		file:        element.Value.(*memoryFile),
+		contentType: contentTypeFromFileName(fileName),
+	}, nil
+}
+
+func (mfs *memoryFileStore) GetFileWriter(fileName string) (io.WriteCloser, error) {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	mfs.remove(fileName)
+
+	file := &memoryFile{
+		name:    fileName,
+		modTime: time.Now(),
+		writing: true,
+	}
+	mfs.files[fileName] = mfs.lru.PushFront(file)
+
+	return &memoryFileWriter{
+		fileStore: mfs,
+		file:      file,
+	}, nil
+}
+
+func (mfs *memoryFileStore) RemoveFile(fileName string) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if !mfs.remove(fileName) {
+		return &os.PathError{Op: "remove", Path: fileName, Err: os.ErrNotExist}
+	}
+
+	return nil
+}
+
+// remove removes the file if it exists, and returns true if it did. The caller must hold the lock.
+func (mfs *memoryFileStore) remove(fileName string) bool {
+	element, exists := mfs.files[fileName]
+	if !exists {
+		return false
+	}
+
+	file := element.Value.(*memoryFile)
+	file.RLock()
+	mfs.size -= int64(len(file.data))
+	file.RUnlock()
+
+	mfs.lru.Remove(element)
+	delete(mfs.files, fileName)
+
+	return true
+}
+
+// reserve makes room for n more bytes, evicting least recently used files as needed.
+// The caller must hold the lock.
+func (mfs *memoryFileStore) reserve(n int64) error {
+	if mfs.capacity == 0 {
+		mfs.size += n
+		return nil
+	}
+
+	for element := mfs.lru.Back(); mfs.size+n > mfs.capacity && element != nil; {
+		file := element.Value.(*memoryFile)
+		element = element.Prev()
+
+		file.RLock()
+		writing := file.writing
+		file.RUnlock()
+
+		if !writing {
+			mfs.remove(file.name)
+		}
+	}
+
+	if mfs.size+n > mfs.capacity {
+		return errMemoryStoreFull
+	}
+
+	mfs.size += n
+	return nil
+}
+
+type memoryFileWriter struct {
+	fileStore *memoryFileStore
+	file      *memoryFile
+}
+
+func (mfw *memoryFileWriter) Write(p []byte) (int, error) {
+	mfw.fileStore.Lock()
+	defer mfw.fileStore.Unlock()
+
+	// the file may have been removed while being written, in which case its size is no longer accounted for
+	if element, exists := mfw.fileStore.files[mfw.file.name]; !exists || element.Value != mfw.file {
+		return 0, &os.PathError{Op: "write", Path: mfw.file.name, Err: os.ErrNotExist}
+	}
+
+	err := mfw.fileStore.reserve(int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	mfw.file.Lock()
+	mfw.file.data = append(mfw.file.data, p...)
+	mfw.file.modTime = time.Now()
+	mfw.file.Unlock()
+
+	return len(p), nil
+}
+
+func (mfw *memoryFileWriter) Close() error {
+	mfw.file.Lock()
+	mfw.file.writing = false
+	mfw.file.Unlock()
+
+	return nil
+}
+
+type memoryFileReader struct {
+	file        *memoryFile
+	contentType string
+	pos         int64
+}
+
+func (mfr *memoryFileReader) ContentType() string {
+	return mfr.contentType
+}
+
+func (mfr *memoryFileReader) Size() (int, error) {
+	mfr.file.RLock()
+	defer mfr.file.RUnlock()
+
+	return len(mfr.file.data), nil
+}
+
+func (mfr *memoryFileReader) ModTime() time.Time {
+	mfr.file.RLock()
+	defer mfr.file.RUnlock()
+
+	return mfr.file.modTime
+}
+
+func (mfr *memoryFileReader) Read(p []byte) (int, error) {
+	mfr.file.RLock()
+	defer mfr.file.RUnlock()
+
+	if mfr.pos >= int64(len(mfr.file.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, mfr.file.data[mfr.pos:])
+	mfr.pos += int64(n)
+
+	return n, nil
+}
+
+func (mfr *memoryFileReader) Seek(offset int64, whence int) (int64, error) {
+	mfr.file.RLock()
+	defer mfr.file.RUnlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = mfr.pos + offset
+	case io.SeekEnd:
+		pos = int64(len(mfr.file.data)) + offset
+	}
+	if pos < 0 {
+		return mfr.pos, os.ErrInvalid
+	}
+
+	mfr.pos = pos
+
+	return pos, nil
+}
+
+func (mfr *memoryFileReader) Close() error {
+	return nil
+}
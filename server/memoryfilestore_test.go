@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestMemoryFileStoreEviction(t *testing.T) {
+	fileStore := newMemoryFileStore(10)
+
+	write := func(fileName string, data string) error {
+		fileWriter, err := fileStore.GetFileWriter(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fileWriter.Close()
+
+		_, err = fileWriter.Write([]byte(data))
+		return err
+	}
+
+	for _, fileName := range []string{"a", "b", "c"} {
+		err := write(fileName, "123")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reading "a" makes "b" the least recently used file
+	fileReader, err := fileStore.GetFileReader("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileReader.Close()
+
+	err = write("d", "123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fileName, wantExists := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		fileReader, err := fileStore.GetFileReader(fileName)
+		if exists := err == nil; exists != wantExists {
+			t.Errorf("file %q: got exists %v, want %v", fileName, exists, wantExists)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil || string(b) != "123" {
+			t.Errorf("file %q: got %q, %v", fileName, b, err)
+		}
+	}
+
+	if err := write("big", "0123456789a"); err != errMemoryStoreFull {
+		t.Errorf("writing a file bigger than the capacity: got error %v, want %v", err, errMemoryStoreFull)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxPasteSize is the size of the largest text file that's shown in the paste view. Larger files are served as they are.
+const maxPasteSize = 512 * 1024
+
+// pasteLanguage describes the syntax of a programming language, for highlighting pastes.
+type pasteLanguage struct {
+	name         string
+	keywords     map[string]bool
+	lineComment  string // Like "//", or empty if there are no line comments.
+	blockComment [2]string
+	quotes       string // Characters that start and end strings.
+	diff         bool   // Lines are highlighted as added or removed instead.
+}
+
+func keywords(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, keyword := range strings.Fields(s) {
+		m[keyword] = true
+	}
+	return m
+}
+
+var (
+	cLanguage = &pasteLanguage{
+		name:         "C",
+		keywords:     keywords("auto break case char const continue default do double else enum extern float for goto if int long register return short signed sizeof static struct switch typedef union unsigned void volatile while #include #define #ifdef #ifndef #endif #if #else"),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	}
+	javaScriptLanguage = &pasteLanguage{
+		name:         "JavaScript",
+		keywords:     keywords("async await break case catch class const continue default delete do else export extends false finally for function if import in instanceof let new null return super switch this throw true try typeof undefined var void while yield"),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	}
+	shellLanguage = &pasteLanguage{
+		name:        "Shell",
+		keywords:    keywords("case do done elif else esac export fi for function if in local return then until while"),
+		lineComment: "#",
+		quotes:      `"'`,
+	}
+)
+
+// pasteLanguages are the languages of files shown in the paste view, by file extension.
+// Text files in other formats are shown without highlighting.
+var pasteLanguages = map[string]*pasteLanguage{
+	".txt": nil,
+	".log": nil,
+	".md":  nil,
+	".go": {
+		name:         "Go",
+		keywords:     keywords("break case chan const continue default defer else fallthrough false for func go goto if import interface map nil package range return select struct switch true type var"),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	".py": {
+		name:        "Python",
+		keywords:    keywords("and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield"),
+		lineComment: "#",
+		quotes:      `"'`,
+	},
+	".rb": {
+		name:        "Ruby",
+		keywords:    keywords("begin break case class def do else elsif end ensure false for if in module next nil not or rescue return self then true unless until when while yield"),
+		lineComment: "#",
+		quotes:      `"'`,
+	},
+	".rs": {
+		name:         "Rust",
+		keywords:     keywords("as break const continue crate else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"`,
+	},
+	".java": {
+		name:         "Java",
+		keywords:     keywords("abstract boolean break byte case catch char class continue default do double else enum extends false final finally float for if implements import instanceof int interface long new null package private protected public return short static super switch this throw throws true try void while"),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	},
+	".sql": {
+		name:         "SQL",
+		keywords:     keywords("SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER INDEX JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AS NULL IS IN select from where and or not insert into values update set delete create table drop alter index join left right inner outer on group by order having limit as null is in"),
+		lineComment:  "--",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `'"`,
+	},
+	".c":     cLanguage,
+	".h":     cLanguage,
+	".cpp":   cLanguage,
+	".js":    javaScriptLanguage,
+	".ts":    javaScriptLanguage,
+	".json":  {name: "JSON", keywords: keywords("true false null"), quotes: `"`},
+	".sh":    shellLanguage,
+	".bash":  shellLanguage,
+	".yaml":  {name: "YAML", keywords: keywords("true false null"), lineComment: "#", quotes: `"'`},
+	".yml":   {name: "YAML", keywords: keywords("true false null"), lineComment: "#", quotes: `"'`},
+	".diff":  {name: "Diff", diff: true},
+	".patch": {name: "Diff", diff: true},
+}
+
+// isPasteFile returns true if the file is text that's shown in the paste view.
+func isPasteFile(fileName string) bool {
+	_, ok := pasteLanguages[path.Ext(fileName)]
+	return ok
+}
+
+// wantsPasteView returns true if the request is from a browser, which gets the paste view instead of the file.
+// Everything else, like curl, gets the file as it is, as do requests with the raw query parameter.
+func wantsPasteView(req *http.Request) bool {
+	if req.URL.Query().Get("raw") != "" {
+		return false
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+var pasteTemplate = template.Must(template.New("paste").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<meta property="og:title" content="{{.Name}}">
+<meta property="og:type" content="website">
+<meta property="og:description" content="{{.Description}}">
+<meta name="twitter:card" content="summary">
+<style>
+body { font-family: sans-serif; margin: 0; }
+header { padding: 0.6em 1em; border-bottom: 1px solid #ddd; background: #f6f6f6; }
+header .language { color: #777; margin-left: 1em; }
+header a { float: right; }
+table { border-collapse: collapse; font-family: monospace; font-size: 13px; }
+td { padding: 0 1em; white-space: pre-wrap; word-break: break-all; vertical-align: top; }
+td.n { color: #999; text-align: right; user-select: none; padding-left: 1em; border-right: 1px solid #ddd; }
+td.n a { color: inherit; text-decoration: none; }
+tr:target { background: #ffc; }
+.k { color: #a626a4; font-weight: bold; }
+.s { color: #50a14f; }
+.c { color: #a0a1a7; font-style: italic; }
+.d { color: #986801; }
+.add { background: #e6ffec; }
+.del { background: #ffebe9; }
+</style>
+</head>
+<body>
+<header>{{.Name}}{{with .Language}}<span class="language">{{.}}</span>{{end}}<a href="?raw=1">Raw</a></header>
+<table>
+{{range $i, $line := .Lines}}<tr id="L{{inc $i}}"><td class="n"><a href="#L{{inc $i}}">{{inc $i}}</a></td><td>{{$line}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// servePaste serves the text file from fileReader as a page with line numbers and syntax highlighting.
+// Files that are too large or aren't UTF-8 text are served as they are, so it returns false without responding for them.
+func servePaste(res http.ResponseWriter, req *http.Request, fileName string, name string, fileReader fileReader) bool {
+	// uploads of unknown length, like a log that's being written, are streamed as they arrive instead
+	if size, err := fileReader.Size(); err != nil || size == -1 || size > maxPasteSize {
+		return false
+	}
+
+	// a paste that's still uploading is read as it arrives, which doesn't take long for one this small
+	b, err := ioutil.ReadAll(io.LimitReader(fileReader, maxPasteSize+1))
+	if err != nil || len(b) > maxPasteSize || !utf8.Valid(b) {
+		if _, seekErr := fileReader.Seek(0, io.SeekStart); seekErr != nil {
+			http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+			return true
+		}
+		return false
+	}
+
+	language := pasteLanguages[path.Ext(fileName)]
+
+	data := struct {
+		Name        string
+		Language    string
+		Description string // Beginning of the text, for link previews.
+		Lines       []template.HTML
+	}{
+		Name:        name,
+		Description: pasteDescription(string(b)),
+		Lines:       highlight(strings.TrimSuffix(string(b), "\n"), language),
+	}
+	if language != nil {
+		data.Language = language.name
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = pasteTemplate.Execute(res, data)
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// pasteDescription returns the beginning of text on one line, shortened to fit in a link preview.
+func pasteDescription(text string) string {
+	const maxLength = 200
+	description := strings.Join(strings.Fields(text), " ")
+	if len(description) <= maxLength {
+		return description
+	}
+	// cut at a character boundary
+	cut := maxLength
+	for cut > 0 && !utf8.RuneStart(description[cut]) {
+		cut--
+	}
+	return description[:cut] + "…"
+}
+
+// highlight returns the lines of src as HTML, with the syntax of language highlighted. language may be nil for plain text.
+func highlight(src string, language *pasteLanguage) []template.HTML {
+	var lines []template.HTML
+	var line strings.Builder
+
+	// emit adds text to the lines, in a span of the given class unless it's empty.
+	// Spans are closed at the end of each line, and opened again on the next one.
+	emit := func(class string, text string) {
+		for {
+			i := strings.IndexByte(text, '\n')
+			part := text
+			if i != -1 {
+				part = text[:i]
+			}
+			if class != "" && part != "" {
+				line.WriteString(`<span class="` + class + `">`)
+				line.WriteString(template.HTMLEscapeString(part))
+				line.WriteString(`</span>`)
+			} else {
+				line.WriteString(template.HTMLEscapeString(part))
+			}
+			if i == -1 {
+				return
+			}
+			lines = append(lines, template.HTML(line.String()))
+			line.Reset()
+			text = text[i+1:]
+		}
+	}
+
+	switch {
+	case language == nil:
+		emit("", src)
+	case language.diff:
+		for _, l := range strings.Split(src, "\n") {
+			switch {
+			case strings.HasPrefix(l, "+++"), strings.HasPrefix(l, "---"), strings.HasPrefix(l, "@@"):
+				emit("c", l+"\n")
+			case strings.HasPrefix(l, "+"):
+				emit("add", l+"\n")
+			case strings.HasPrefix(l, "-"):
+				emit("del", l+"\n")
+			default:
+				emit("", l+"\n")
+			}
+		}
+		return lines
+	default:
+		highlightCode(src, language, emit)
+	}
+
+	lines = append(lines, template.HTML(line.String()))
+	return lines
+}
+
+// highlightCode splits src into comments, strings, numbers, keywords and everything else, and passes them to emit in order.
+func highlightCode(src string, language *pasteLanguage, emit func(class string, text string)) {
+	plain := 0 // start of the text that isn't highlighted and hasn't been emitted yet
+	i := 0
+	token := func(class string, end int) {
+		emit("", src[plain:i])
+		emit(class, src[i:end])
+		i, plain = end, end
+	}
+
+	for i < len(src) {
+		rest := src[i:]
+		c := src[i]
+		switch {
+		case language.blockComment[0] != "" && strings.HasPrefix(rest, language.blockComment[0]):
+			end := strings.Index(rest[len(language.blockComment[0]):], language.blockComment[1])
+			if end == -1 {
+				token("c", len(src))
+			} else {
+				token("c", i+len(language.blockComment[0])+end+len(language.blockComment[1]))
+			}
+		case language.lineComment != "" && strings.HasPrefix(rest, language.lineComment) &&
+			(language.lineComment != "#" || i == 0 || isSpace(src[i-1])):
+			end := strings.IndexByte(rest, '\n')
+			if end == -1 {
+				token("c", len(src))
+			} else {
+				token("c", i+end)
+			}
+		case strings.IndexByte(language.quotes, c) != -1:
+			end := i + 1
+			for end < len(src) && src[end] != c {
+				if src[end] == '\\' {
+					end++
+				} else if src[end] == '\n' && c != '`' {
+					break
+				}
+				end++
+			}
+			if end < len(src) && src[end] == c {
+				end++
+			}
+			if end > len(src) {
+				end = len(src)
+			}
+			token("s", end)
+		case isWordByte(c) || c == '#':
+			end := i + 1
+			for end < len(src) && isWordByte(src[end]) {
+				end++
+			}
+			word := src[i:end]
+			if i > 0 && isWordByte(src[i-1]) {
+				i = end
+			} else if language.keywords[word] {
+				token("k", end)
+			} else if c >= '0' && c <= '9' {
+				token("d", end)
+			} else {
+				i = end
+			}
+		default:
+			i++
+		}
+	}
+	emit("", src[plain:])
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+var (
+	errQuotaExceeded = errors.New("storage quota exceeded; delete some shares to make room")
+	errStorageFull   = errors.New("the server is out of storage space")
+)
+
+// quotas limit how much storage each user, and everyone together, may use.
+// Users' usage is that of their shares that haven't expired, along with the bytes their uploads in progress
+// have reserved, and is checked as uploads are prepared and started.
+type quotas struct {
+	maxUserBytes int // Zero means unlimited.
+	maxUserFiles int // Zero means unlimited.
+
+	// Nothing can be uploaded while the volume holding storagePath is more than maxDiskUsage percent full.
+	// An empty storagePath, or a maxDiskUsage of 0 or 100, disables the check.
+	storagePath  string
+	maxDiskUsage int
+}
+
+// quotaUsage is a user's usage of their quotas, as returned by /api/quota.
+type quotaUsage struct {
+	Bytes       int  `json:"bytes"`
+	MaxBytes    int  `json:"maxBytes"` // Zero means unlimited.
+	Files       int  `json:"files"`
+	MaxFiles    int  `json:"maxFiles"` // Zero means unlimited.
+	StorageFull bool `json:"storageFull"`
+}
+
+// storageFull returns true if the storage volume is fuller than allowed.
+func (q *quotas) storageFull() bool {
+	if q.storagePath == "" || q.maxDiskUsage <= 0 || q.maxDiskUsage >= 100 {
+		return false
+	}
+
+	usage, err := diskUsage(q.storagePath)
+	if err != nil {
+		log.Println("Failed to check disk usage:", err)
+		return false
+	}
+
+	return usage*100 > float64(q.maxDiskUsage)
+}
+
+// check returns an error if the user can't upload any more, or can't add another file if newFile is set.
+// uploadingBytes is how many bytes the user's uploads in progress have reserved.
+func (q *quotas) check(shares *shareStore, userName string, uploadingBytes int, newFile bool) error {
+	if q.storageFull() {
+		return errStorageFull
+	}
+
+	bytes, files := shares.Usage(userName)
+	bytes += uploadingBytes
+	if q.maxUserBytes != 0 && bytes >= q.maxUserBytes {
+		return errQuotaExceeded
+	}
+	if newFile && q.maxUserFiles != 0 && files >= q.maxUserFiles {
+		return errQuotaExceeded
+	}
+
+	return nil
+}
+
+// remainingBytes returns how many more bytes the user may upload, or -1 if there's no limit.
+func (q *quotas) remainingBytes(shares *shareStore, userName string, uploadingBytes int) int {
+	if q.maxUserBytes == 0 {
+		return -1
+	}
+
+	bytes, _ := shares.Usage(userName)
+	bytes += uploadingBytes
+	if bytes >= q.maxUserBytes {
+		return 0
+	}
+	return q.maxUserBytes - bytes
+}
+
+// usage returns the user's usage of their quotas.
+func (q *quotas) usage(shares *shareStore, userName string, uploadingBytes int) quotaUsage {
+	bytes, files := shares.Usage(userName)
+	return quotaUsage{
+		Bytes:       bytes + uploadingBytes,
+		MaxBytes:    q.maxUserBytes,
+		Files:       files,
+		MaxFiles:    q.maxUserFiles,
+		StorageFull: q.storageFull(),
+	}
+}
@@ -0,0 +1,91 @@
+// Package ratelimit limits how often clients may make requests, with a token bucket for each client.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter allows each key, like a client's IP address or user name, to do something perMinute times per minute.
+// A key that's been idle may use up a whole minute's worth at once.
+type Limiter struct {
+	rate  float64 // Tokens added to each bucket per second.
+	burst float64 // Tokens a bucket can hold.
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+
+	sync.Mutex
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// New creates a Limiter that allows perMinute actions per minute for each key.
+func New(perMinute int) *Limiter {
+	return &Limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of each of the keys, returning true if they all had one. Otherwise, no tokens
+// are taken, so a request that's refused by one key's limit doesn't use up the others, and it returns how long it
+// will be until they all have one.
+func (l *Limiter) Allow(keys ...string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	allowed := true
+	var retryAfter time.Duration
+	buckets := make([]*bucket, len(keys))
+	for i, key := range keys {
+		b, exists := l.buckets[key]
+		if !exists {
+			b = &bucket{tokens: l.burst, updated: now}
+			l.buckets[key] = b
+		}
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+		b.updated = now
+
+		if b.tokens < 1 {
+			allowed = false
+			if wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second)); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+		buckets[i] = b
+	}
+	if !allowed {
+		return false, retryAfter
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// sweep forgets the buckets that have filled up since they were last used, as they'd be created full anyway.
+// Buckets fill up in at most a minute, so it's done once a minute. The caller must hold the lock.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
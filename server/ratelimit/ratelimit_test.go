@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(6)
+	l.now = func() time.Time { return now }
+
+	// a minute's worth is allowed at once
+	for i := 0; i < 6; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d wasn't allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok || retryAfter != 10*time.Second {
+		t.Errorf("got %v, %v; want false, 10s", ok, retryAfter)
+	}
+
+	// other keys have buckets of their own
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another key wasn't allowed")
+	}
+
+	// a token is added every 10 seconds
+	now = now.Add(5 * time.Second)
+	if ok, retryAfter := l.Allow("a"); ok || retryAfter != 5*time.Second {
+		t.Errorf("after 5s: got %v, %v; want false, 5s", ok, retryAfter)
+	}
+	now = now.Add(5 * time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("after 10s: request wasn't allowed")
+	}
+
+	// several keys are only charged if they all have a token
+	if ok, retryAfter := l.Allow("d", "a"); ok || retryAfter != 10*time.Second {
+		t.Errorf("with an empty bucket: got %v, %v; want false, 10s", ok, retryAfter)
+	}
+	for i := 0; i < 6; i++ {
+		if ok, _ := l.Allow("d"); !ok {
+			t.Fatalf("request %d for a key refused along with another wasn't allowed", i+1)
+		}
+	}
+	if ok, _ := l.Allow("b", "e"); !ok {
+		t.Error("keys with tokens weren't allowed together")
+	}
+	if ok, _ := l.Allow("d", "e"); ok {
+		t.Error("keys were allowed together although one had no tokens")
+	}
+
+	// full buckets are forgotten
+	now = now.Add(2 * time.Minute)
+	l.Allow("c")
+	if len(l.buckets) != 1 {
+		t.Errorf("got %d buckets after they filled up, want 1", len(l.buckets))
+	}
+}
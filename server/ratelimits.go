@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pavben/InstantShare/server/ratelimit"
+)
+
+// rateLimits limit how often each client IP address and each user may prepare, upload and download files.
+// A nil limiter doesn't limit anything.
+type rateLimits struct {
+	prepare  *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+	download *ratelimit.Limiter
+
+	// Header that a reverse proxy in front of the server puts the client's address in, like X-Forwarded-For.
+	// Empty means clients connect directly.
+	clientIPHeader string
+}
+
+func newRateLimits(cfg *config) *rateLimits {
+	newLimiter := func(perMinute int) *ratelimit.Limiter {
+		if perMinute == 0 {
+			return nil
+		}
+		return ratelimit.New(perMinute)
+	}
+
+	return &rateLimits{
+		prepare:        newLimiter(cfg.prepareRate),
+		upload:         newLimiter(cfg.uploadRate),
+		download:       newLimiter(cfg.downloadRate),
+		clientIPHeader: cfg.clientIPHeader,
+	}
+}
+
+// limiter returns the limiter for the kind of request, if it's limited.
+func (rl *rateLimits) limiter(req *http.Request, path []string) *ratelimit.Limiter {
+	switch {
+	case len(path) == 2 && path[0] == "api" && (path[1] == "getfilename" || path[1] == "getbundle"):
+		return rl.prepare
+	case len(path) == 0 || path[0] == "api":
+		return nil
+	case req.Method == "PUT" || req.Method == "PATCH":
+		return rl.upload
+	case req.Method == "GET" || req.Method == "HEAD":
+		return rl.download
+	default:
+		return nil
+	}
+}
+
+// allow returns true if the request is within the rate limits of its client's IP address, and of its user if it has an API key.
+// Otherwise, it responds with 429 Too Many Requests, saying when to try again.
+func (rl *rateLimits) allow(res http.ResponseWriter, req *http.Request, path []string, userKeys *userKeys) bool {
+	limiter := rl.limiter(req, path)
+	if limiter == nil {
+		return true
+	}
+
+	// requests with bad keys are limited by their address alone, which also slows down guessing keys
+	keys := []string{"ip:" + rl.clientIP(req)}
+	if userKey, err := userKeys.authenticate(req); err == nil {
+		keys = append(keys, "user:"+userKeys.userName(userKey))
+	}
+
+	// the request is charged to every key or to none, so that one limit refusing it doesn't use up the others
+	allowed, retryAfter := limiter.Allow(keys...)
+	if !allowed {
+		log.Println("Rate limited", req.Method, req.URL.Path, "for", strings.Join(keys, ", "))
+		res.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		http.Error(res, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// clientIP returns the IP address of the client that made the request.
+func (rl *rateLimits) clientIP(req *http.Request) string {
+	if rl.clientIPHeader != "" {
+		// the proxy appends the address it received the request from, so earlier ones may have been made up by the client
+		addrs := strings.Split(req.Header.Get(rl.clientIPHeader), ",")
+		if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+			return addr
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// retryAfterSeconds formats a duration for the Retry-After header, which is in whole seconds.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
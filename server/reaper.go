@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// reapExpiredShares periodically removes the files of shares that have expired, and forgets the records of shares
+// that were removed more than retention ago. It never returns.
+func reapExpiredShares(activeFileManager *activeFileManager, shares *shareStore, fileStore fileStore, interval time.Duration, retention time.Duration) {
+	for range time.Tick(interval) {
+		forgotten, err := shares.ForgetRemoved(time.Now(), retention)
+		if err != nil {
+			log.Println("Failed to forget removed shares:", err)
+		} else if forgotten > 0 {
+			log.Println("Forgot", forgotten, "removed shares")
+		}
+
+		for _, fileName := range shares.ExpiredFileNames(time.Now()) {
+			// leave files that are still uploading alone; they'll be picked up once the upload finishes
+			if activeFileManager.IsActive(fileName) {
+				continue
+			}
+
+			// a bundle may have expired by being downloaded, rather than with time like its files
+			if record, _ := shares.Get(fileName); record.Bundle {
+				err := activeFileManager.Delete(fileName)
+				if err != nil {
+					log.Println("Failed to remove expired bundle:", err)
+					continue
+				}
+
+				log.Println("Removed expired bundle", fileName)
+				continue
+			}
+
+			err := removeFile(fileStore, shares, fileName)
+			if err != nil {
+				log.Println("Failed to remove expired file:", err)
+				continue
+			}
+
+			err = shares.MarkExpired(fileName)
+			if err != nil {
+				log.Println("Failed to mark share as expired:", err)
+				continue
+			}
+
+			log.Println("Removed expired file", fileName)
+		}
+	}
+}
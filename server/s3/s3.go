@@ -0,0 +1,312 @@
+// Package s3 is a minimal client for S3-compatible object storage.
+//
+// It implements just the operations needed to store uploaded files:
+// simple and multipart uploads, ranged downloads, and deletes, along with the conditional reads and writes
+// needed to share the server's state between instances. Requests use path-style
+// addressing and are signed with AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client accesses objects in a single bucket.
+type Client struct {
+	Endpoint        string // Base URL of the service, like "https://s3.amazonaws.com" or "http://localhost:9000".
+	Region          string // Like "us-east-1".
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	HTTPClient *http.Client // If nil, http.DefaultClient is used.
+}
+
+// Error is returned when the service responds with a non-successful status code.
+type Error struct {
+	StatusCode int
+	Code       string // S3 error code, like "NoSuchKey". May be empty, as in responses to HEAD requests.
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound returns true if err indicates that the object doesn't exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsNotModified returns true if err indicates that the object still has the ETag given to GetObjectIfChanged.
+func IsNotModified(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotModified
+}
+
+// IsPreconditionFailed returns true if err indicates that PutObjectIfUnchanged didn't store the object,
+// because it was changed in the meantime.
+func IsPreconditionFailed(err error) bool {
+	e, ok := err.(*Error)
+	// a write that races with another conditional write of the same object may be refused with 409 Conflict
+	return ok && (e.StatusCode == http.StatusPreconditionFailed || e.StatusCode == http.StatusConflict)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size         int64
+	LastModified time.Time
+}
+
+// PutObject stores an object with the given contents in a single request.
+func (c *Client) PutObject(key string, data []byte) error {
+	resp, err := c.do("PUT", key, nil, nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// PutObjectIfUnchanged stores an object with the given contents, as long as it still has the ETag given,
+// or doesn't exist yet if etag is empty. It returns the object's new ETag. If the object was changed,
+// it returns an error for which IsPreconditionFailed is true.
+func (c *Client) PutObjectIfUnchanged(key string, data []byte, etag string) (string, error) {
+	header := make(http.Header)
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+
+	resp, err := c.do("PUT", key, nil, header, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// HeadObject returns information about an object.
+func (c *Client) HeadObject(key string) (ObjectInfo, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return ObjectInfo{
+		Size:         resp.ContentLength,
+		LastModified: lastModified,
+	}, nil
+}
+
+// GetObject returns the contents of an object, starting at offset.
+// The caller must close the returned body.
+func (c *Client) GetObject(key string, offset int64) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := c.do("GET", key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// GetObjectIfChanged returns the whole contents of an object and its ETag. If etag isn't empty and
+// the object still has it, it returns an error for which IsNotModified is true instead.
+func (c *Client) GetObjectIfChanged(key string, etag string) ([]byte, string, error) {
+	header := make(http.Header)
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+
+	resp, err := c.do("GET", key, nil, header, nil, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return b, resp.Header.Get("ETag"), nil
+}
+
+// DeleteObject removes an object. Deleting an object that doesn't exist is not an error.
+func (c *Client) DeleteObject(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CreateMultipartUpload starts a multipart upload of an object and returns its upload ID.
+func (c *Client) CreateMultipartUpload(key string) (string, error) {
+	resp, err := c.do("POST", key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.UploadID, nil
+}
+
+// CompletedPart identifies an uploaded part of a multipart upload.
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// UploadPart uploads one part of a multipart upload. Part numbers start at 1.
+// All parts except the last must be at least 5 MiB.
+func (c *Client) UploadPart(key string, uploadID string, partNumber int, data []byte) (CompletedPart, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+
+	resp, err := c.do("PUT", key, query, nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return CompletedPart{}, err
+	}
+	resp.Body.Close()
+
+	return CompletedPart{
+		PartNumber: partNumber,
+		ETag:       resp.Header.Get("ETag"),
+	}, nil
+}
+
+// CompleteMultipartUpload assembles the uploaded parts into the object.
+func (c *Client) CompleteMultipartUpload(key string, uploadID string, parts []CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("POST", key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the service may report an error inside a 200 OK response, since it only knows the outcome after starting to respond
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if e := parseError(resp.StatusCode, b); e != nil {
+		return e
+	}
+
+	return nil
+}
+
+// AbortMultipartUpload discards a multipart upload and any parts uploaded so far.
+func (c *Client) AbortMultipartUpload(key string, uploadID string) error {
+	resp, err := c.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a signed request for key, and returns the response if its status code indicates success.
+func (c *Client) do(method string, key string, query url.Values, header http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	objectPath := strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket + "/" + key
+	u.Path = objectPath
+	u.RawPath = uriEncode(objectPath, false)
+	u.RawQuery = canonicalQueryString(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	c.sign(req, time.Now())
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if e := parseError(resp.StatusCode, b); e != nil {
+			return nil, e
+		}
+		return nil, &Error{StatusCode: resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+// parseError returns the error described by an S3 error response body, or nil if body doesn't describe one.
+func parseError(statusCode int, body []byte) *Error {
+	var errorResponse struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}
+	err := xml.Unmarshal(body, &errorResponse)
+	if err != nil {
+		return nil
+	}
+
+	if statusCode >= 200 && statusCode <= 299 {
+		statusCode = http.StatusInternalServerError
+	}
+
+	return &Error{
+		StatusCode: statusCode,
+		Code:       errorResponse.Code,
+		Message:    errorResponse.Message,
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pavben/InstantShare/server/s3"
+)
+
+// s3PartSize is the size of parts in multipart uploads. S3 requires all but the last part to be at least 5 MiB.
+const s3PartSize = 8 * 1024 * 1024
+
+// s3FileStore stores files as objects in an S3-compatible bucket.
+//
+// Objects only appear in the bucket once their upload is complete, so files being written
+// are also spooled to a local directory, where they can be read while the upload is in progress.
+// Uploads in progress are local to the server that receives them, but once they're in the bucket,
+// any server using it can serve them.
+type s3FileStore struct {
+	client    *s3.Client
+	keyPrefix string
+	spoolPath string
+	spooled   map[string]string // File name -> path of the spool file, for files being written.
+
+	sync.Mutex
+}
+
+func newS3FileStore(client *s3.Client, keyPrefix string, spoolPath string) (fileStore, error) {
+	err := os.MkdirAll(spoolPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3FileStore{
+		client:    client,
+		keyPrefix: keyPrefix,
+		spoolPath: spoolPath,
+		spooled:   make(map[string]string),
+	}, nil
+}
+
+func (sfs *s3FileStore) GetFileReader(fileName string) (fileReader, error) {
+	sfs.Lock()
+	spoolFilePath, spooled := sfs.spooled[fileName]
+	sfs.Unlock()
+
+	if spooled {
+		file, err := os.Open(spoolFilePath)
+		if err == nil {
+			return &diskFileReader{
+				file:        file,
+				contentType: contentTypeFromFileName(fileName),
+			}, nil
+		}
+		// the upload may have just finished and removed its spool file; fall back to the bucket
+	}
+
+	info, err := sfs.client.HeadObject(sfs.key(fileName))
+	if s3.IsNotFound(err) {
+		return nil, &os.PathError{Op: "open", Path: sfs.key(fileName), Err: os.ErrNotExist}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &s3FileReader{
+		client:      sfs.client,
+		key:         sfs.key(fileName),
+		info:        info,
+		contentType: contentTypeFromFileName(fileName),
+	}, nil
+}
+
+func (sfs *s3FileStore) GetFileWriter(fileName string) (io.WriteCloser, error) {
+	// files of different bundles may have the same base name, so the spool file is named after the whole name
+	spoolFile, err := os.Create(filepath.Join(sfs.spoolPath, strings.Replace(fileName, "/", "-", -1)+".spool"))
+	if err != nil {
+		return nil, err
+	}
+
+	sfs.Lock()
+	sfs.spooled[fileName] = spoolFile.Name()
+	sfs.Unlock()
+
+	return &s3FileWriter{
+		fileStore: sfs,
+		fileName:  fileName,
+		spoolFile: spoolFile,
+	}, nil
+}
+
+func (sfs *s3FileStore) RemoveFile(fileName string) error {
+	return sfs.client.DeleteObject(sfs.key(fileName))
+}
+
+func (sfs *s3FileStore) key(fileName string) string {
+	return sfs.keyPrefix + fileName
+}
+
+// s3FileWriter writes a file to its spool file, and uploads it to the bucket in parts as it's written.
+type s3FileWriter struct {
+	fileStore *s3FileStore
+	fileName  string
+	spoolFile *os.File
+
+	part     []byte // Data not yet uploaded.
+	uploadID string // Set once the multipart upload has been started.
+	parts    []s3.CompletedPart
+}
+
+func (sfw *s3FileWriter) Write(p []byte) (int, error) {
+	// readers of the spool file see the data through the page cache as soon as Write returns, and the file is
+	// removed once it's in the bucket, so it's never synced to disk
+	bytesWritten, err := sfw.spoolFile.Write(p)
+	if err != nil {
+		return bytesWritten, err
+	}
+
+	sfw.part = append(sfw.part, p...)
+
+	if len(sfw.part) >= s3PartSize {
+		err = sfw.uploadPart()
+		if err != nil {
+			return bytesWritten, err
+		}
+	}
+
+	return bytesWritten, nil
+}
+
+func (sfw *s3FileWriter) uploadPart() error {
+	client := sfw.fileStore.client
+	key := sfw.fileStore.key(sfw.fileName)
+
+	if sfw.uploadID == "" {
+		uploadID, err := client.CreateMultipartUpload(key)
+		if err != nil {
+			return err
+		}
+		sfw.uploadID = uploadID
+	}
+
+	part, err := client.UploadPart(key, sfw.uploadID, len(sfw.parts)+1, sfw.part)
+	if err != nil {
+		return err
+	}
+
+	sfw.parts = append(sfw.parts, part)
+	sfw.part = sfw.part[:0]
+
+	return nil
+}
+
+// Close uploads the remaining data and completes the upload, then removes the spool file.
+func (sfw *s3FileWriter) Close() (err error) {
+	defer func() {
+		sfw.fileStore.Lock()
+		delete(sfw.fileStore.spooled, sfw.fileName)
+		sfw.fileStore.Unlock()
+
+		sfw.spoolFile.Close()
+		os.Remove(sfw.spoolFile.Name())
+	}()
+
+	client := sfw.fileStore.client
+	key := sfw.fileStore.key(sfw.fileName)
+
+	// small files are uploaded in a single request
+	if sfw.uploadID == "" {
+		return client.PutObject(key, sfw.part)
+	}
+
+	if len(sfw.part) > 0 {
+		err = sfw.uploadPart()
+	}
+	if err == nil {
+		err = client.CompleteMultipartUpload(key, sfw.uploadID, sfw.parts)
+	}
+	if err != nil {
+		abortErr := client.AbortMultipartUpload(key, sfw.uploadID)
+		if abortErr != nil {
+			log.Println("Failed to abort multipart upload:", abortErr)
+		}
+	}
+
+	return err
+}
+
+// s3FileReader reads an object from the bucket. Seeking is done by starting a new ranged download.
+type s3FileReader struct {
+	client      *s3.Client
+	key         string
+	info        s3.ObjectInfo
+	contentType string
+
+	body io.ReadCloser // The current download, if one has been started.
+	pos  int64
+}
+
+func (sfr *s3FileReader) ContentType() string {
+	return sfr.contentType
+}
+
+func (sfr *s3FileReader) Size() (int, error) {
+	return int(sfr.info.Size), nil
+}
+
+func (sfr *s3FileReader) ModTime() time.Time {
+	return sfr.info.LastModified
+}
+
+func (sfr *s3FileReader) Read(p []byte) (int, error) {
+	if sfr.pos >= sfr.info.Size {
+		return 0, io.EOF
+	}
+
+	if sfr.body == nil {
+		body, err := sfr.client.GetObject(sfr.key, sfr.pos)
+		if err != nil {
+			return 0, err
+		}
+		sfr.body = body
+	}
+
+	n, err := sfr.body.Read(p)
+	sfr.pos += int64(n)
+
+	return n, err
+}
+
+func (sfr *s3FileReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = sfr.pos + offset
+	case io.SeekEnd:
+		pos = sfr.info.Size + offset
+	}
+	if pos < 0 {
+		return sfr.pos, os.ErrInvalid
+	}
+
+	// the current download can only be reused if the position doesn't change
+	if pos != sfr.pos && sfr.body != nil {
+		sfr.body.Close()
+		sfr.body = nil
+	}
+	sfr.pos = pos
+
+	return pos, nil
+}
+
+func (sfr *s3FileReader) Close() error {
+	if sfr.body == nil {
+		return nil
+	}
+
+	err := sfr.body.Close()
+	sfr.body = nil
+
+	return err
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errShareExpired  = errors.New("share has expired")
+	errNoSuchBundle  = errors.New("no bundle with this name")
+	errBundleHasFile = errors.New("bundle already has a file with this name")
+	errShareExists   = errors.New("a share with this name exists")
+
+	// errUnchanged is returned by the functions passed to shareStore.change when there's nothing to save yet.
+	errUnchanged = errors.New("share records are unchanged")
+)
+
+// shareRecord is what's persisted about each share, in addition to the file contents in the fileStore.
+type shareRecord struct {
+	Uploader        string // Name of the user who prepared the share.
+	DeleteTokenHash string // Hex-encoded SHA-256 of the share's delete token.
+
+	OriginalName string `json:",omitempty"` // Name of the file on the uploader's machine, if known.
+	ContentType  string `json:",omitempty"` // Content-Type declared by the upload.
+	Size         int    // Set once the upload finishes.
+	SHA256       string `json:",omitempty"` // Hex-encoded SHA-256 of the contents, set once the upload finishes.
+
+	Created      time.Time
+	Uploaded     time.Time // Zero until the upload finishes.
+	Expires      time.Time // Zero means the share doesn't expire with time.
+	MaxDownloads int       `json:",omitempty"` // Zero means unlimited.
+	Downloads    int       `json:",omitempty"`
+	Expired      bool      `json:",omitempty"` // Set once the share has expired or was deleted, and its file was removed.
+	Removed      time.Time // When the share's file was removed. The record is forgotten a while later.
+
+	// Bundles are shares of several files, each with its own record named "<bundle name>/<file name>".
+	// The files inherit the bundle's uploader, delete token and expiry time.
+	Bundle bool     `json:",omitempty"`
+	Files  []string `json:",omitempty"` // Names of the files of a bundle, in the order they were added.
+
+	Variants []string `json:",omitempty"` // Names of resized or converted copies of an image in the fileStore, removed along with it.
+}
+
+// contentType returns the Content-Type the file should be served with.
+// Declared types that say nothing about the contents are ignored in favor of guessing from the file extension.
+func (sr *shareRecord) contentType(fileName string) string {
+	if sr.ContentType == "" || sr.ContentType == "application/octet-stream" {
+		return contentTypeFromFileName(fileName)
+	}
+	return sr.ContentType
+}
+
+// hashDeleteToken returns the value to store as shareRecord.DeleteTokenHash for deleteToken.
+func hashDeleteToken(deleteToken string) string {
+	hash := sha256.Sum256([]byte(deleteToken))
+	return hex.EncodeToString(hash[:])
+}
+
+// isDeleteToken returns true if deleteToken is the share's delete token.
+func (sr *shareRecord) isDeleteToken(deleteToken string) bool {
+	if deleteToken == "" || sr.DeleteTokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeleteToken(deleteToken)), []byte(sr.DeleteTokenHash)) == 1
+}
+
+// isExpired returns true if the share should no longer be served at time now.
+func (sr *shareRecord) isExpired(now time.Time) bool {
+	switch {
+	case sr.Expired:
+		return true
+	case !sr.Expires.IsZero() && !now.Before(sr.Expires):
+		return true
+	case sr.MaxDownloads > 0 && sr.Downloads >= sr.MaxDownloads:
+		return true
+	default:
+		return false
+	}
+}
+
+// downloadsSaveDelay is how long new download counts may go unsaved. Saving the records on every download
+// would rewrite the whole file for each one; if the server crashes, the last few downloads aren't counted.
+var downloadsSaveDelay = 5 * time.Second
+
+// shareStore keeps shareRecords in memory and persists them to a stateStorage on every change.
+// Download counts are saved a little later, along with the other changes made in the meantime.
+//
+// The records are copied as they're changed, and written once the lock is released,
+// so that reading them isn't held up while they're written.
+//
+// If other instances of the server share the storage, each change is made to the latest records, and made again
+// if another instance saves them first. Download counts are saved right away, and reads may not see
+// other instances' changes for up to sharedStateMaxAge.
+type shareStore struct {
+	storage   stateStorage
+	records   map[string]*shareRecord
+	saveTimer *time.Timer // Set while a save is scheduled.
+	changes   int         // Number of changes made, which orders the copies of the records.
+	refreshed time.Time   // When the records were last loaded or saved.
+
+	sync.Mutex
+
+	saved     int        // Number of changes in the copy written last.
+	version   string     // Version of the records in the storage.
+	saveMutex sync.Mutex // Held while the records are loaded or written, and guards saved and version.
+}
+
+func newShareStore(storage stateStorage) (*shareStore, error) {
+	shareStore := &shareStore{
+		storage: storage,
+		records: make(map[string]*shareRecord),
+	}
+
+	shareStore.saveMutex.Lock()
+	defer shareStore.saveMutex.Unlock()
+
+	err := shareStore.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return shareStore, nil
+}
+
+// Add creates a record for a newly prepared share.
+// If another instance of the server has added a share with the same name, it returns errShareExists.
+func (ss *shareStore) Add(fileName string, record shareRecord) error {
+	return ss.change(func() error {
+		if _, exists := ss.records[fileName]; exists {
+			return errShareExists
+		}
+
+		ss.records[fileName] = &record
+		return nil
+	})
+}
+
+// AddBundleFile adds a file with the given name to a bundle, and creates its record.
+func (ss *shareStore) AddBundleFile(bundleName string, name string, now time.Time) error {
+	return ss.change(func() error {
+		return ss.addBundleFile(bundleName, name, now)
+	})
+}
+
+// addBundleFile does the work of AddBundleFile. The caller must hold the lock.
+func (ss *shareStore) addBundleFile(bundleName string, name string, now time.Time) error {
+	bundle, exists := ss.records[bundleName]
+	if !exists || !bundle.Bundle {
+		return errNoSuchBundle
+	}
+	if bundle.isExpired(now) {
+		return errShareExpired
+	}
+	for _, existingName := range bundle.Files {
+		if existingName == name {
+			return errBundleHasFile
+		}
+	}
+
+	bundle.Files = append(bundle.Files, name)
+	ss.records[bundleName+"/"+name] = &shareRecord{
+		Uploader:        bundle.Uploader,
+		DeleteTokenHash: bundle.DeleteTokenHash,
+		OriginalName:    name,
+		Created:         now,
+		Expires:         bundle.Expires,
+	}
+
+	return nil
+}
+
+// Get returns a copy of the share's record, if it has one.
+func (ss *shareStore) Get(fileName string) (shareRecord, bool) {
+	ss.refresh()
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	record, exists := ss.records[fileName]
+	if !exists {
+		return shareRecord{}, false
+	}
+
+	recordCopy := *record
+	recordCopy.Files = append([]string(nil), record.Files...)
+	recordCopy.Variants = append([]string(nil), record.Variants...)
+
+	return recordCopy, true
+}
+
+// Update calls updateFunc to modify the share's record, if it has one, and persists the result.
+func (ss *shareStore) Update(fileName string, updateFunc func(record *shareRecord)) error {
+	return ss.change(func() error {
+		record, exists := ss.records[fileName]
+		if !exists {
+			return errUnchanged
+		}
+
+		updateFunc(record)
+		return nil
+	})
+}
+
+// Remove forgets about a share entirely, as if it never existed. Files of bundles are removed from their bundle.
+func (ss *shareStore) Remove(fileName string) error {
+	return ss.change(func() error {
+		return ss.remove(fileName)
+	})
+}
+
+// remove does the work of Remove. The caller must hold the lock.
+func (ss *shareStore) remove(fileName string) error {
+	if _, exists := ss.records[fileName]; !exists {
+		return errUnchanged
+	}
+
+	delete(ss.records, fileName)
+
+	if slashIdx := strings.Index(fileName, "/"); slashIdx != -1 {
+		if bundle, exists := ss.records[fileName[:slashIdx]]; exists {
+			name := fileName[slashIdx+1:]
+			for i, existingName := range bundle.Files {
+				if existingName == name {
+					bundle.Files = append(bundle.Files[:i], bundle.Files[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Usage returns the total size and number of the files shared by the user that haven't expired.
+// Files that are still uploading count towards the number, but not the size.
+func (ss *shareStore) Usage(userName string) (int, int) {
+	ss.refresh()
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	var bytes, files int
+	for _, record := range ss.records {
+		if record.Uploader != userName || record.Bundle || record.Expired {
+			continue
+		}
+		bytes += record.Size
+		files++
+	}
+
+	return bytes, files
+}
+
+// IsExpired returns true if the share has a record and it has expired.
+func (ss *shareStore) IsExpired(fileName string, now time.Time) bool {
+	ss.refresh()
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	record, exists := ss.records[fileName]
+
+	return exists && record.isExpired(now)
+}
+
+// CountDownload records a new download of the share, returning errShareExpired if it can no longer be downloaded.
+// Shares without a record can always be downloaded.
+func (ss *shareStore) CountDownload(fileName string, now time.Time) error {
+	return ss.change(func() error {
+		record, exists := ss.records[fileName]
+		if !exists {
+			return errUnchanged
+		}
+
+		if record.isExpired(now) {
+			return errShareExpired
+		}
+
+		record.Downloads++
+
+		if record.isExpired(now) || ss.storage.Shared() {
+			// the last download is saved right away, so that it can't be downloaded again after a crash,
+			// and other instances of the server count downloads of the share too
+			return nil
+		}
+
+		ss.saveLater()
+		return errUnchanged
+	})
+}
+
+// ExpiredFileNames returns the names of shares that have expired at time now, but whose files have not yet been removed.
+func (ss *shareStore) ExpiredFileNames(now time.Time) []string {
+	ss.refresh()
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	var fileNames []string
+
+	for fileName, record := range ss.records {
+		if !record.Expired && record.isExpired(now) {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+
+	return fileNames
+}
+
+// MarkExpired records that the share's file has been removed, so that it's reported as gone rather than not found.
+// Deleted shares are marked expired too.
+func (ss *shareStore) MarkExpired(fileName string) error {
+	return ss.change(func() error {
+		record, exists := ss.records[fileName]
+		if !exists {
+			return errUnchanged
+		}
+
+		record.Expired = true
+		record.Removed = time.Now()
+		return nil
+	})
+}
+
+// ForgetRemoved removes the records of shares whose files were removed more than retention ago, after which they're reported as not found.
+func (ss *shareStore) ForgetRemoved(now time.Time, retention time.Duration) (int, error) {
+	var forgotten int
+	err := ss.change(func() error {
+		forgotten = 0
+		for fileName, record := range ss.records {
+			removed := record.Removed
+			if removed.IsZero() {
+				// removed before removal times were kept
+				removed = record.Created
+			}
+			if record.Expired && now.Sub(removed) >= retention {
+				delete(ss.records, fileName)
+				forgotten++
+			}
+		}
+		if forgotten == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+
+	return forgotten, err
+}
+
+// saveLater schedules a save in downloadsSaveDelay, unless one is already scheduled. The caller must hold the lock.
+func (ss *shareStore) saveLater() {
+	if ss.saveTimer != nil {
+		return
+	}
+
+	ss.saveTimer = time.AfterFunc(downloadsSaveDelay, func() {
+		err := ss.change(func() error { return nil })
+		if err != nil {
+			log.Println("Failed to save share records:", err)
+		}
+	})
+}
+
+// change calls changeFunc with the lock held, and saves the records unless it returns an error.
+// errUnchanged isn't returned to the caller. changeFunc may be called again, if other instances of the server
+// share the records and one saves them first.
+func (ss *shareStore) change(changeFunc func() error) error {
+	if ss.storage.Shared() {
+		return ss.changeShared(changeFunc)
+	}
+
+	ss.Lock()
+	err := changeFunc()
+	if err != nil {
+		ss.Unlock()
+		if err == errUnchanged {
+			return nil
+		}
+		return err
+	}
+
+	// a scheduled save is no longer needed
+	if ss.saveTimer != nil {
+		ss.saveTimer.Stop()
+		ss.saveTimer = nil
+	}
+
+	ss.changes++
+	changes := ss.changes
+	b, err := json.MarshalIndent(ss.records, "", "\t")
+	ss.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return ss.save(b, changes)
+}
+
+// save writes a copy of the records to the storage, unless a later copy has been written already.
+// Since that copy includes the changes in this one, they're saved all the same.
+func (ss *shareStore) save(b []byte, changes int) error {
+	ss.saveMutex.Lock()
+	defer ss.saveMutex.Unlock()
+
+	if changes <= ss.saved {
+		return nil
+	}
+
+	_, err := ss.storage.Save(b, ss.version)
+	if err != nil {
+		return err
+	}
+
+	ss.saved = changes
+	return nil
+}
+
+// changeShared makes a change to records that other instances of the server share. The latest records are
+// loaded first, and if another instance saves them before the change is saved, it's made again to theirs.
+func (ss *shareStore) changeShared(changeFunc func() error) error {
+	ss.saveMutex.Lock()
+	defer ss.saveMutex.Unlock()
+
+	for {
+		err := ss.load()
+		if err != nil {
+			return err
+		}
+
+		ss.Lock()
+		err = changeFunc()
+		if err != nil {
+			ss.Unlock()
+			if err == errUnchanged {
+				return nil
+			}
+			return err
+		}
+		b, err := json.MarshalIndent(ss.records, "", "\t")
+		ss.Unlock()
+		if err != nil {
+			return err
+		}
+
+		version, err := ss.storage.Save(b, ss.version)
+		if err == errStateChanged {
+			continue
+		} else if err != nil {
+			// the records hold a change that wasn't saved, so they're loaded again in full
+			ss.version = ""
+			return err
+		}
+
+		ss.version = version
+		ss.Lock()
+		ss.refreshed = time.Now()
+		ss.Unlock()
+		return nil
+	}
+}
+
+// load replaces the records with those in the storage, unless they haven't changed since they were last loaded
+// or saved. The caller must hold saveMutex.
+func (ss *shareStore) load() error {
+	b, version, err := ss.storage.Load(ss.version)
+	if err == errStateUnchanged {
+		ss.Lock()
+		ss.refreshed = time.Now()
+		ss.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	records := make(map[string]*shareRecord)
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &records)
+		if err != nil {
+			return err
+		}
+	}
+
+	ss.version = version
+	ss.Lock()
+	ss.records = records
+	ss.refreshed = time.Now()
+	ss.Unlock()
+	return nil
+}
+
+// refresh loads the records again if other instances of the server share them, and they were last loaded
+// or saved more than sharedStateMaxAge ago.
+func (ss *shareStore) refresh() {
+	if !ss.storage.Shared() {
+		return
+	}
+
+	ss.Lock()
+	fresh := time.Since(ss.refreshed) < sharedStateMaxAge
+	ss.Unlock()
+	if fresh {
+		return
+	}
+
+	ss.saveMutex.Lock()
+	defer ss.saveMutex.Unlock()
+
+	err := ss.load()
+	if err != nil {
+		log.Println("Failed to load share records:", err)
+	}
+}
+
+// shareFileReader is a fileReader that takes the file's metadata from its share record.
+type shareFileReader struct {
+	fileReader
+	fileName string
+	record   shareRecord
+}
+
+func (sfr *shareFileReader) ContentType() string {
+	return sfr.record.contentType(sfr.fileName)
+}
+
+func (sfr *shareFileReader) ModTime() time.Time {
+	if sfr.record.Uploaded.IsZero() {
+		return sfr.fileReader.ModTime()
+	}
+	return sfr.record.Uploaded
+}
+
+// Record returns the metadata of the share being read, as it was when the reader was created.
+func (sfr *shareFileReader) Record() shareRecord {
+	return sfr.record
+}
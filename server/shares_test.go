@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadCountsSavedLater(t *testing.T) {
+	oldDelay := downloadsSaveDelay
+	downloadsSaveDelay = 50 * time.Millisecond
+	defer func() { downloadsSaveDelay = oldDelay }()
+
+	path := filepath.Join(t.TempDir(), "shares.json")
+	shares, err := newShareStore(&fileStateStorage{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	err = shares.Add("a.txt", shareRecord{Created: now, MaxDownloads: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloads := func() int {
+		saved, err := newShareStore(&fileStateStorage{path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, _ := saved.Get("a.txt")
+		return record.Downloads
+	}
+
+	for i := 0; i < 2; i++ {
+		err := shares.CountDownload("a.txt", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := downloads(); got != 0 {
+		t.Errorf("got %d downloads saved right away, want 0", got)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if got := downloads(); got != 2 {
+		t.Errorf("got %d downloads saved after the delay, want 2", got)
+	}
+
+	// the last download is saved right away
+	err = shares.CountDownload("a.txt", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := downloads(); got != 3 {
+		t.Errorf("got %d downloads saved after the last one, want 3", got)
+	}
+}
+
+func TestForgetRemoved(t *testing.T) {
+	shares, err := newShareStore(&fileStateStorage{path: filepath.Join(t.TempDir(), "shares.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, fileName := range []string{"removed.txt", "live.txt"} {
+		err := shares.Add(fileName, shareRecord{Created: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = shares.MarkExpired("removed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if forgotten, err := shares.ForgetRemoved(time.Now(), time.Hour); err != nil || forgotten != 0 {
+		t.Errorf("got %d, %v before the retention period, want 0, nil", forgotten, err)
+	}
+	if !shares.IsExpired("removed.txt", time.Now()) {
+		t.Error("removed share isn't reported as expired during the retention period")
+	}
+
+	if forgotten, err := shares.ForgetRemoved(time.Now().Add(2*time.Hour), time.Hour); err != nil || forgotten != 1 {
+		t.Errorf("got %d, %v after the retention period, want 1, nil", forgotten, err)
+	}
+	if _, exists := shares.Get("removed.txt"); exists {
+		t.Error("removed share is still remembered")
+	}
+	if _, exists := shares.Get("live.txt"); !exists {
+		t.Error("live share was forgotten")
+	}
+}
+
+func TestSaveOutsideLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.json")
+	shares, err := newShareStore(&fileStateStorage{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while the records are being written, as to a slow disk, they can still be read
+	shares.saveMutex.Lock()
+	added := make(chan error)
+	go func() {
+		added <- shares.Add("a.txt", shareRecord{Created: time.Now()})
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, exists := shares.Get("a.txt"); exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("record wasn't added while the records were being written")
+		}
+	}
+	shares.saveMutex.Unlock()
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+
+	// changes made at the same time are all saved, whichever order they're written in
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := shares.Add(fmt.Sprintf("%d.txt", i), shareRecord{Created: time.Now()})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	saved, err := newShareStore(&fileStateStorage{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, exists := saved.Get(fmt.Sprintf("%d.txt", i)); !exists {
+			t.Errorf("%d.txt wasn't saved", i)
+		}
+	}
+}
+
+// sharedStateStorage is a stateStorage that several shareStores share, like instances of the server sharing a bucket.
+type sharedStateStorage struct {
+	data    []byte
+	version int
+
+	sync.Mutex
+}
+
+func (sss *sharedStateStorage) Load(version string) ([]byte, string, error) {
+	sss.Lock()
+	defer sss.Unlock()
+
+	if sss.version == 0 {
+		return nil, "", nil
+	}
+	if version == strconv.Itoa(sss.version) {
+		return nil, "", errStateUnchanged
+	}
+	return append([]byte(nil), sss.data...), strconv.Itoa(sss.version), nil
+}
+
+func (sss *sharedStateStorage) Save(data []byte, version string) (string, error) {
+	sss.Lock()
+	defer sss.Unlock()
+
+	if (sss.version == 0 && version != "") || (sss.version != 0 && version != strconv.Itoa(sss.version)) {
+		return "", errStateChanged
+	}
+	sss.data = append([]byte(nil), data...)
+	sss.version++
+	return strconv.Itoa(sss.version), nil
+}
+
+func (sss *sharedStateStorage) Shared() bool {
+	return true
+}
+
+func TestSharedShareStores(t *testing.T) {
+	oldMaxAge := sharedStateMaxAge
+	sharedStateMaxAge = 50 * time.Millisecond
+	defer func() { sharedStateMaxAge = oldMaxAge }()
+
+	storage := &sharedStateStorage{}
+	a, err := newShareStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newShareStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	err = a.Add("a.txt", shareRecord{Created: now, MaxDownloads: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b's change is made to the records that a saved, rather than replacing them
+	err = b.Add("b.txt", shareRecord{Created: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("a.txt", shareRecord{Created: now}); err != errShareExists {
+		t.Errorf("got %v adding a share that the other store added, want errShareExists", err)
+	}
+
+	// a sees b's share once its records are old enough to be loaded again
+	time.Sleep(100 * time.Millisecond)
+	for _, fileName := range []string{"a.txt", "b.txt"} {
+		for name, shares := range map[string]*shareStore{"a": a, "b": b} {
+			if _, exists := shares.Get(fileName); !exists {
+				t.Errorf("%s doesn't have %s", name, fileName)
+			}
+		}
+	}
+
+	// downloads counted by both stores at once add up to the limit
+	var wg sync.WaitGroup
+	var counted sync.Map
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shares := a
+			if i%2 == 1 {
+				shares = b
+			}
+			err := shares.CountDownload("a.txt", now)
+			if err == nil {
+				counted.Store(i, true)
+			} else if err != errShareExpired {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	counted.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	if n != 5 {
+		t.Errorf("got %d downloads counted, want 5", n)
+	}
+
+	saved, err := newShareStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := saved.Get("a.txt"); record.Downloads != 5 {
+		t.Errorf("got %d downloads saved, want 5", record.Downloads)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pavben/InstantShare/atomicfile"
+	"github.com/pavben/InstantShare/server/s3"
+)
+
+var (
+	errStateUnchanged = errors.New("state is unchanged")
+	errStateChanged   = errors.New("state was changed by another instance of the server")
+)
+
+// stateDir is the directory of the bucket that the server's state is kept in with -store=s3, next to the files.
+// Share names never start with an underscore.
+const stateDir = "_state"
+
+// sharedStateMaxAge is how long state shared with other instances of the server is used before it's loaded again.
+// Changes are always made to the latest state, but reads may not see other instances' changes for this long.
+var sharedStateMaxAge = time.Second
+
+// stateStorage persists a JSON document of the server's state, like the share records.
+type stateStorage interface {
+	// Load returns the document and its version. If it's still at version, it returns errStateUnchanged instead.
+	// A document that doesn't exist yet is empty, with an empty version.
+	Load(version string) ([]byte, string, error)
+	// Save replaces the document and returns its new version. If it's no longer at version,
+	// because another instance of the server saved it since, it returns errStateChanged instead.
+	Save(data []byte, version string) (string, error)
+	// Shared returns true if other instances of the server use the same document.
+	Shared() bool
+}
+
+// fileStateStorage keeps the document in a local file, which only this instance of the server uses.
+type fileStateStorage struct {
+	path string
+}
+
+func (fss *fileStateStorage) Load(version string) ([]byte, string, error) {
+	b, err := ioutil.ReadFile(fss.path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	return b, "", err
+}
+
+func (fss *fileStateStorage) Save(data []byte, version string) (string, error) {
+	return "", atomicfile.WriteFile(fss.path, data, 0600)
+}
+
+func (fss *fileStateStorage) Shared() bool {
+	return false
+}
+
+// bucketStateStorage keeps the document in an object of an S3-compatible bucket, where every instance of
+// the server using the bucket can see it. Its versions are the object's ETags, and it's only replaced
+// if it still has the ETag it was loaded with.
+type bucketStateStorage struct {
+	client *s3.Client
+	key    string
+}
+
+func (bss *bucketStateStorage) Load(version string) ([]byte, string, error) {
+	b, etag, err := bss.client.GetObjectIfChanged(bss.key, version)
+	switch {
+	case s3.IsNotModified(err):
+		return nil, "", errStateUnchanged
+	case s3.IsNotFound(err):
+		return nil, "", nil
+	case err != nil:
+		return nil, "", err
+	}
+	return b, etag, nil
+}
+
+func (bss *bucketStateStorage) Save(data []byte, version string) (string, error) {
+	etag, err := bss.client.PutObjectIfUnchanged(bss.key, data, version)
+	if s3.IsPreconditionFailed(err) {
+		return "", errStateChanged
+	}
+	return etag, err
+}
+
+func (bss *bucketStateStorage) Shared() bool {
+	return true
+}
@@ -5,47 +5,52 @@ import "time"
 // Timeout is an interface for objects that facilitate managing active timeouts, allowing resetting and canceling
 type Timeout interface {
 	Reset() bool
+	SetDuration(duration time.Duration) bool
 	Cancel() bool
 }
 
 type responseChanType chan bool
 type controlChanType chan responseChanType
 
+type durationRequest struct {
+	duration     time.Duration
+	responseChan responseChanType
+}
+
 type timeout struct {
-	resetChan  controlChanType
-	cancelChan controlChanType
+	resetChan    controlChanType
+	durationChan chan durationRequest
+	cancelChan   controlChanType
+	done         chan struct{} // Closed once the timeout has been triggered or cancelled.
 }
 
 // New creates a Timeout, which calls timeoutFunc after duration.
 // It can be reset or cancelled.
 func New(duration time.Duration, timeoutFunc func()) Timeout {
 	timeout := &timeout{
-		resetChan:  make(controlChanType),
-		cancelChan: make(controlChanType),
+		resetChan:    make(controlChanType),
+		durationChan: make(chan durationRequest),
+		cancelChan:   make(controlChanType),
+		done:         make(chan struct{}),
 	}
 
 	go func() {
-	ActiveLoop:
 		for {
 			select {
 			case <-time.After(duration):
+				// from now on, Reset, SetDuration and Cancel return false, and the goroutine exits
+				close(timeout.done)
 				timeoutFunc()
-				break ActiveLoop
+				return
 			case responseChan := <-timeout.resetChan:
 				responseChan <- true
+			case request := <-timeout.durationChan:
+				duration = request.duration
+				request.responseChan <- true
 			case responseChan := <-timeout.cancelChan:
+				close(timeout.done)
 				responseChan <- true
-				break ActiveLoop
-			}
-		}
-
-		// now that the timeout has been triggered or cancelled, Reset and Cancel will be returning false
-		for {
-			select {
-			case responseChan := <-timeout.resetChan:
-				responseChan <- false
-			case responseChan := <-timeout.cancelChan:
-				responseChan <- false
+				return
 			}
 		}
 	}()
@@ -56,15 +61,33 @@ func New(duration time.Duration, timeoutFunc func()) Timeout {
 func (t *timeout) Reset() bool {
 	responseChan := make(responseChanType)
 
-	t.resetChan <- responseChan
+	select {
+	case t.resetChan <- responseChan:
+		return <-responseChan
+	case <-t.done:
+		return false
+	}
+}
+
+// SetDuration changes how long the timeout waits, and resets it.
+func (t *timeout) SetDuration(duration time.Duration) bool {
+	responseChan := make(responseChanType)
 
-	return <-responseChan
+	select {
+	case t.durationChan <- durationRequest{duration: duration, responseChan: responseChan}:
+		return <-responseChan
+	case <-t.done:
+		return false
+	}
 }
 
 func (t *timeout) Cancel() bool {
 	responseChan := make(responseChanType)
 
-	t.cancelChan <- responseChan
-
-	return <-responseChan
+	select {
+	case t.cancelChan <- responseChan:
+		return <-responseChan
+	case <-t.done:
+		return false
+	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a TLS certificate loaded from files, and reloads them when the process receives SIGHUP,
+// so that renewed certificates can be picked up without a restart.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+
+	sync.RWMutex
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	cr := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+
+		for range sighup {
+			err := cr.reload()
+			if err != nil {
+				// keep serving the previous certificate
+				log.Println("Failed to reload TLS certificate:", err)
+				continue
+			}
+			log.Println("Reloaded TLS certificate")
+		}
+	}()
+
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cr.Lock()
+	cr.cert = &cert
+	cr.Unlock()
+
+	return nil
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+
+	return cr.cert, nil
+}
+
+// hstsHandler tells browsers to only ever access the server over HTTPS, for maxAge.
+func hstsHandler(handler http.Handler, maxAge time.Duration) http.Handler {
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Strict-Transport-Security", value)
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// httpsRedirectHandler redirects requests to the same URL over HTTPS, on the port of httpsListenAddr.
+func httpsRedirectHandler(httpsListenAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsListenAddr)
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			// no port in the Host header
+			host = req.Host
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		// 308 makes clients repeat uploads with the same method and body, which 301 doesn't guarantee
+		statusCode := http.StatusPermanentRedirect
+		if req.Method == "GET" || req.Method == "HEAD" {
+			statusCode = http.StatusMovedPermanently
+		}
+
+		http.Redirect(res, req, "https://"+host+req.URL.RequestURI(), statusCode)
+	})
+}
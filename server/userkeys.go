@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	errMissingUserKey  = errors.New("missing or invalid API key")
+	errUserKeyMismatch = errors.New("upload was prepared with a different API key")
+)
+
+// userKeys holds the API keys that are allowed to upload, along with the names of the users they were issued to.
+type userKeys struct {
+	users map[string]string // API key -> user name.
+}
+
+// loadUserKeys reads a user keys file. Each non-empty line that does not start with "#" has the form "<user name> <API key>".
+func loadUserKeys(path string) (*userKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	uk := &userKeys{
+		users: make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<user name> <API key>\"", path, lineNumber)
+		}
+		if _, exists := uk.users[fields[1]]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate API key", path, lineNumber)
+		}
+		uk.users[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return uk, nil
+}
+
+// generateToken returns a new random secret, suitable as an API key or a delete token.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authenticate returns the API key from the request's "Authorization: Bearer <key>" header,
+// or errMissingUserKey if there is none or it's not a known key.
+func (uk *userKeys) authenticate(req *http.Request) (string, error) {
+	const prefix = "Bearer "
+
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", errMissingUserKey
+	}
+
+	userKey := strings.TrimSpace(authorization[len(prefix):])
+	if _, exists := uk.users[userKey]; !exists {
+		return "", errMissingUserKey
+	}
+
+	return userKey, nil
+}
+
+// userName returns the name of the user that userKey was issued to.
+func (uk *userKeys) userName(userKey string) string {
+	return uk.users[userKey]
+}
@@ -0,0 +1,354 @@
+// Package upload implements the uploading side of the Instant Share API. It's used by the Instant Share clients.
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResumeAttempts is how many times an interrupted upload is resumed before giving up.
+const maxResumeAttempts = 5
+
+// resumeDelay is how long to wait before resuming an interrupted upload. The server aborts uploads that
+// receive no data for a while (10 seconds by default), so it must be well under that.
+var resumeDelay = time.Second
+
+// prepareTimeout limits how long preparing an upload may take, since a share's URL is needed right away.
+const prepareTimeout = 10 * time.Second
+
+// Client uploads files to an Instant Share server.
+type Client struct {
+	Host string        // Server host, like "share.example.com". HTTPS is used unless another scheme is given, like "http://localhost:27080".
+	Key  string        // API key for the server.
+	TTL  time.Duration // If non-zero, shares expire after this long.
+
+	// HTTPClient is used to make requests. If nil, http.DefaultClient is used.
+	// It should not have a Timeout, since that would also limit how long uploads can take.
+	HTTPClient *http.Client
+}
+
+// Share is a file that has been prepared for upload.
+type Share struct {
+	URL         string // Where the file can be downloaded from, as soon as its upload begins.
+	DeleteToken string // Token that allows anyone holding it to delete the share.
+}
+
+// StatusError is returned when the server responds with an unexpected status code.
+type StatusError struct {
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("did not get acceptable status code: %v body: %q", e.Status, e.Body)
+}
+
+// Prepare reserves a URL for a file with the given extension, like "png". If name is not empty,
+// it's the original name of the file, which browsers use when saving the download.
+func (c *Client) Prepare(extension string, name string) (*Share, error) {
+	query := url.Values{"ext": {extension}}
+	if name != "" {
+		query.Set("name", name)
+	}
+
+	return c.prepare("getfilename", query, "")
+}
+
+// PrepareBundle reserves a URL for a bundle of files, which serves a page listing them. Files are added to the bundle
+// by uploading them to BundleFileURL.
+func (c *Client) PrepareBundle() (*Share, error) {
+	return c.prepare("getbundle", url.Values{}, "/")
+}
+
+// BundleFileURL returns the URL of the file with the given name in the bundle at bundleURL.
+func BundleFileURL(bundleURL string, name string) string {
+	return bundleURL + url.PathEscape(name)
+}
+
+// prepare calls the API method that prepares a share, and returns the share with urlSuffix added to its URL.
+func (c *Client) prepare(method string, query url.Values, urlSuffix string) (*Share, error) {
+	if c.TTL != 0 {
+		query.Set("ttl", c.TTL.String())
+	}
+
+	req, err := http.NewRequest("GET", c.hostURL()+"/api/"+method+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prepareTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	fileName, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Share{
+		URL:         c.hostURL() + "/" + string(fileName) + urlSuffix,
+		DeleteToken: resp.Header.Get("X-Delete-Token"),
+	}, nil
+}
+
+// Upload sends the contents of the file prepared at shareURL, read from r. If size is -1, the length of the file
+// is not known, and it's sent with chunked encoding until r reaches io.EOF. If progress is not nil,
+// it's called with the number of bytes sent so far as the upload proceeds.
+//
+// shareURL may also be the BundleFileURL of a new file in a bundle.
+// If the upload is interrupted and r is an io.Seeker, the upload is resumed from where the server left off.
+func (c *Client) Upload(shareURL string, r io.Reader, size int64, progress func(sent int64)) error {
+	body := newProgressReader(r, 0, progress)
+	err := c.put(shareURL, body, size)
+	body.waitClosed()
+
+	seeker, canResume := r.(io.Seeker)
+	if size == -1 {
+		// the server decides where an upload of unknown length ends, so it can't be resumed reliably
+		canResume = false
+	}
+
+	for attempt := 1; err != nil && canResume && isResumable(err) && attempt <= maxResumeAttempts; attempt++ {
+		time.Sleep(resumeDelay)
+
+		var offset int64
+		offset, err = c.uploadOffset(shareURL)
+		if err != nil {
+			continue
+		}
+		if offset > size {
+			return fmt.Errorf("server received %d bytes, more than the %d bytes being uploaded", offset, size)
+		}
+
+		_, err = seeker.Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		body = newProgressReader(r, offset, progress)
+		err = c.patch(shareURL, body, offset, size-offset)
+		body.waitClosed()
+	}
+
+	return err
+}
+
+// Delete takes down the share at shareURL, using its deleteToken if not empty, or else the Client's key.
+func (c *Client) Delete(shareURL string, deleteToken string) error {
+	req, err := http.NewRequest("DELETE", shareURL, nil)
+	if err != nil {
+		return err
+	}
+	if deleteToken != "" {
+		req.Header.Set("X-Delete-Token", deleteToken)
+	}
+
+	resp, err := c.do(req, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// maxThumbnailSize limits how much of a thumbnail is read, in case the server sends something else.
+const maxThumbnailSize = 1024 * 1024
+
+// Thumbnail returns a JPEG of the image shared at shareURL, scaled down to width. It's fetched with the Client's key,
+// so it doesn't count as a download of the share if the Client shared it.
+func (c *Client) Thumbnail(shareURL string, width int) ([]byte, error) {
+	query := url.Values{"w": {strconv.Itoa(width)}, "format": {"jpeg"}}
+	req, err := http.NewRequest("GET", shareURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxThumbnailSize))
+}
+
+func (c *Client) put(shareURL string, body io.ReadCloser, size int64) error {
+	req, err := http.NewRequest("PUT", shareURL, body)
+	if err != nil {
+		// the HTTP client closes the body once it's done with it, but it never got it
+		body.Close()
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// uploadOffset asks the server how many bytes of the file at shareURL it has received.
+func (c *Client) uploadOffset(shareURL string) (int64, error) {
+	req, err := http.NewRequest("HEAD", shareURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// patch sends the rest of the file, starting at offset, to continue an interrupted upload.
+func (c *Client) patch(shareURL string, body io.ReadCloser, offset int64, size int64) error {
+	req, err := http.NewRequest("PATCH", shareURL, body)
+	if err != nil {
+		// the HTTP client closes the body once it's done with it, but it never got it
+		body.Close()
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	resp, err := c.do(req, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// do sends req with the Client's key, and returns a *StatusError if the response status code isn't wantStatusCode.
+func (c *Client) do(req *http.Request, wantStatusCode int) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != wantStatusCode {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, &StatusError{
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	return resp, nil
+}
+
+// IsShareURL returns true if s is a link to something on the server, like a share.
+func (c *Client) IsShareURL(s string) bool {
+	return strings.HasPrefix(s, c.hostURL()+"/")
+}
+
+// hostURL returns the base URL of the server, defaulting to HTTPS if Host has no scheme.
+func (c *Client) hostURL() string {
+	host := strings.TrimSuffix(c.Host, "/")
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return host
+}
+
+// FormatSize formats n bytes for people, like "12.3 MiB".
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n) / unit
+	prefixes := "KMGTPE"
+	i := 0
+	for value >= unit && i < len(prefixes)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, prefixes[i])
+}
+
+// isResumable returns true if err means the upload was interrupted, rather than refused by the server.
+func isResumable(err error) bool {
+	statusError, isStatusError := err.(*StatusError)
+	if !isStatusError {
+		return true
+	}
+
+	// the server may not have noticed the interruption yet, or received more data than we thought
+	return statusError.StatusCode == http.StatusConflict
+}
+
+// progressReader reports the number of bytes read through it, counting from an initial offset.
+//
+// It's used as a request body. The HTTP client may keep reading a body after a failed request returns,
+// so before the underlying reader is reused, waitClosed must be called to wait for the client to let go of it.
+type progressReader struct {
+	reader    io.Reader
+	progress  func(sent int64)
+	sent      int64
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newProgressReader(r io.Reader, offset int64, progress func(sent int64)) *progressReader {
+	return &progressReader{
+		reader:   r,
+		progress: progress,
+		sent:     offset,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	pr.sent += int64(n)
+	if pr.progress != nil && n > 0 {
+		pr.progress(pr.sent)
+	}
+	return n, err
+}
+
+func (pr *progressReader) Close() error {
+	pr.closeOnce.Do(func() { close(pr.closed) })
+	return nil
+}
+
+// waitClosed waits until the HTTP client is done with the request body.
+func (pr *progressReader) waitClosed() {
+	<-pr.closed
+}
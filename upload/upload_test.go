@@ -0,0 +1,148 @@
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer accepts a single upload, and drops the connection of the first PUT after receiving interruptAfter bytes.
+type fakeServer struct {
+	interruptAfter int
+
+	data []byte
+	done bool
+
+	sync.Mutex
+}
+
+func (fs *fakeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer key" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/api/getfilename":
+		w.Header().Set("X-Delete-Token", "token")
+		w.Write([]byte("abc." + req.URL.Query().Get("ext")))
+	case req.Method == "PUT":
+		buf := make([]byte, fs.interruptAfter)
+		n, _ := req.Body.Read(buf)
+		fs.Lock()
+		fs.data = append(fs.data, buf[:n]...)
+		fs.Unlock()
+		panic(http.ErrAbortHandler)
+	case req.Method == "HEAD":
+		fs.Lock()
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(fs.data)))
+		fs.Unlock()
+	case req.Method == "PATCH":
+		fs.Lock()
+		defer fs.Unlock()
+		if req.Header.Get("Upload-Offset") != strconv.Itoa(len(fs.data)) {
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+		rest, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fs.data = append(fs.data, rest...)
+		fs.done = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	resumeDelay = 10 * time.Millisecond
+
+	fs := &fakeServer{interruptAfter: 100}
+	ts := httptest.NewServer(fs)
+	defer ts.Close()
+
+	c := &Client{Host: ts.URL, Key: "key"}
+
+	share, err := c.Prepare("txt", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if share.URL != ts.URL+"/abc.txt" || share.DeleteToken != "token" {
+		t.Fatalf("got %+v", share)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var lastSent int64
+	err = c.Upload(share.URL, bytes.NewReader(data), int64(len(data)), func(sent int64) {
+		lastSent = sent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	if !fs.done || !bytes.Equal(fs.data, data) {
+		t.Errorf("server got %d bytes, done: %v; want %d bytes", len(fs.data), fs.done, len(data))
+	}
+	if lastSent != int64(len(data)) {
+		t.Errorf("last progress report was %d bytes, want %d", lastSent, len(data))
+	}
+}
+
+func TestUploadRefused(t *testing.T) {
+	ts := httptest.NewServer(&fakeServer{})
+	defer ts.Close()
+
+	c := &Client{Host: ts.URL, Key: "wrong"}
+
+	_, err := c.Prepare("txt", "")
+	if statusError, ok := err.(*StatusError); !ok || statusError.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %v, want a StatusError with 401", err)
+	}
+}
+
+func TestUploadBadURL(t *testing.T) {
+	c := &Client{Host: "http://localhost", Key: "key"}
+
+	uploadDone := make(chan error)
+	go func() {
+		uploadDone <- c.Upload("http://[::1", strings.NewReader("hello"), 5, nil)
+	}()
+
+	select {
+	case err := <-uploadDone:
+		if err == nil {
+			t.Error("got no error for a malformed URL")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload didn't return")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{123 << 20 / 10, "12.3 MiB"},
+		{5 << 60, "5.0 EiB"},
+	} {
+		if got := FormatSize(tc.n); got != tc.want {
+			t.Errorf("FormatSize(%d): got %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package upload
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ZipDirectory returns a zip archive of the directory at dir, which is built as it's read, so that it's never
+// held in memory as a whole. Paths in the archive begin with the name of the directory. Symbolic links and
+// other special files are left out. The length of the archive is not known in advance,
+// so it's uploaded with a size of -1.
+//
+// The caller must close the returned reader, which stops building the archive if it hasn't been read to the end.
+func ZipDirectory(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(writeZip(pw, dir))
+	}()
+
+	return pr
+}
+
+func writeZip(w io.Writer, dir string) error {
+	dir = filepath.Clean(dir)
+	parent := filepath.Dir(dir)
+
+	zipWriter := zip.NewWriter(w)
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			header.Name += "/"
+			_, err = zipWriter.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+
+		fileWriter, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(fileWriter, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return zipWriter.Close()
+}
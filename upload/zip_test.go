@@ -0,0 +1,75 @@
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZipDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "photos")
+	files := map[string]string{
+		"photos/a.txt":       "first",
+		"photos/trip/b.txt":  "second",
+		"photos/trip/c.json": "{}",
+	}
+	for name, contents := range files {
+		path := filepath.Join(filepath.Dir(dir), filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := ZipDirectory(dir)
+	zipData, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for _, zipFile := range zipReader.File {
+		if zipFile.FileInfo().IsDir() {
+			continue
+		}
+		fr, err := zipFile.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[zipFile.Name] = string(contents)
+	}
+
+	if len(got) != len(files) {
+		t.Errorf("got %d files, want %d: %v", len(got), len(files), got)
+	}
+	for name, contents := range files {
+		if got[name] != contents {
+			t.Errorf("got %q for %s, want %q", got[name], name, contents)
+		}
+	}
+}
+
+func TestZipDirectoryMissing(t *testing.T) {
+	r := ZipDirectory(filepath.Join(t.TempDir(), "nonexistent"))
+	defer r.Close()
+
+	if _, err := ioutil.ReadAll(r); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+}